@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessConfig is the optional access section of settings.json: who may
+// reach the server, and how often a client may switch plugs
+type accessConfig struct {
+	API       []string `json:"api,omitempty"`       // addresses or CIDRs allowed to connect to the API; empty for all
+	Discovery []string `json:"discovery,omitempty"` // addresses or CIDRs whose discovery requests are answered; empty for all
+	SetRate   float64  `json:"setrate,omitempty"`   // set requests per second allowed per client address; 0 for no limit
+	SetBurst  int      `json:"setburst,omitempty"`  // set requests a client address may make at once, default 5
+}
+
+const (
+	defaultSetBurst     = 5
+	rateLimitMaxClients = 1024 // client addresses remembered by the rate limiter
+)
+
+// accessRules is the parsed form of accessConfig
+type accessRules struct {
+	api       ipAllowlist
+	discovery ipAllowlist
+	setRate   float64
+	setBurst  int
+}
+
+// rules parses c. Entries the validator rejected are skipped.
+func (c accessConfig) rules() accessRules {
+	r := accessRules{
+		api:       parseAllowlist(c.API),
+		discovery: parseAllowlist(c.Discovery),
+		setRate:   c.SetRate,
+		setBurst:  c.SetBurst,
+	}
+	if r.setBurst == 0 {
+		r.setBurst = defaultSetBurst
+	}
+	return r
+}
+
+func (s *sw) accessRules() accessRules {
+	sm.RLock()
+	defer sm.RUnlock()
+	return s.access
+}
+
+// ipAllowlist holds the networks allowed in; an empty list allows everyone
+type ipAllowlist []netip.Prefix
+
+func parseAllowlist(entries []string) ipAllowlist {
+	var l ipAllowlist
+	for _, e := range entries {
+		if p, err := parseAllowEntry(e); err == nil {
+			l = append(l, p)
+		}
+	}
+	return l
+}
+
+// parseAllowEntry accepts a CIDR such as 192.168.1.0/24 or a single address
+func parseAllowEntry(e string) (netip.Prefix, error) {
+	if strings.Contains(e, "/") {
+		p, err := netip.ParsePrefix(e)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(e)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// allows reports whether addr, a net.Addr of a connection or packet, is
+// inside the list
+func (l ipAllowlist) allows(addr net.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap().WithZone("")
+	for _, p := range l {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowDiscovery reports whether discovery requests from addr are answered
+func allowDiscovery(addr net.Addr) bool {
+	return s.accessRules().discovery.allows(addr)
+}
+
+// allowListener drops API connections from addresses outside access.api
+// before any HTTP or TLS is spoken
+type allowListener struct {
+	net.Listener
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if s.accessRules().api.allows(c.RemoteAddr()) {
+			return c, nil
+		}
+		slog.Debug("Refused API connection", "remote", c.RemoteAddr().String())
+		c.Close()
+	}
+}
+
+// rateLimiter keeps a token bucket per client address
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var setLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the bucket of key, which refills at rate per
+// second up to burst. When it is empty it returns the time until the next
+// token.
+func (l *rateLimiter) allow(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		// Forget clients whose buckets have refilled so the map cannot grow without bound
+		if len(l.buckets) >= rateLimitMaxClients {
+			for k, old := range l.buckets {
+				if old.tokens+now.Sub(old.last).Seconds()*rate >= float64(burst) {
+					delete(l.buckets, k)
+				}
+			}
+			// Too many clients are busy; refuse new ones until a bucket refills
+			if len(l.buckets) >= rateLimitMaxClients {
+				return false, time.Duration(float64(time.Second) / rate)
+			}
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund gives back a token taken by allow
+func (l *rateLimiter) refund(key string, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = min(float64(burst), b.tokens+1)
+	}
+}
+
+// clientHost returns the IP address of a remote address such as
+// r.RemoteAddr, which limiters key on
+func clientHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+// setRetryAfter sets the Retry-After header for a wait and returns it in
+// whole seconds
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) int {
+	retry := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	return retry
+}
+
+// isSetRequest reports whether r changes something through the Alpaca or
+// REST API
+func isSetRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/v1/") || strings.HasPrefix(r.URL.Path, "/v1/switches")
+}
+
+// rateLimit refuses set requests from clients that exceed access.setrate.
+// Clients are told apart by remote address only, as anyone can pick a new
+// Alpaca ClientID. Alpaca clients get an Alpaca error, REST clients 429.
+func (srv *ApiServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := s.accessRules()
+		if rules.setRate <= 0 || !isSetRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientHost(auditSourceFrom(r.Context()).Remote)
+		ok, wait := setLimiter.allow(key, rules.setRate, rules.setBurst, time.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retry := setRetryAfter(w, wait)
+		loggerFrom(r.Context()).Warn("Rate limit exceeded", "client", key, "retry", retry)
+		msg := fmt.Sprintf("rate limit exceeded, retry in %ds", retry)
+		if isAlpacaRequest(r) {
+			srv.handleAlpacaError(w, r, errRateLimitedNumber, msg)
+			return
+		}
+		writeRestError(w, http.StatusTooManyRequests, msg)
+	})
+}
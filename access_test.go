@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	// Two per second with a burst of three, all from one client
+	steps := []struct {
+		at   time.Duration
+		ok   bool
+		wait time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		{10 * time.Second, true, 0}, // refilled to the burst, not beyond
+		{10 * time.Second, true, 0},
+		{10 * time.Second, true, 0},
+		{10 * time.Second, false, 500 * time.Millisecond},
+	}
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	start := time.Now()
+	for i, st := range steps {
+		ok, wait := l.allow("192.168.1.10", 2, 3, start.Add(st.at))
+		if ok != st.ok || wait != st.wait {
+			t.Errorf("step %d at %s: got %v, %s, want %v, %s", i, st.at, ok, wait, st.ok, st.wait)
+		}
+	}
+	if ok, _ := l.allow("192.168.1.11", 2, 3, start.Add(10*time.Second)); !ok {
+		t.Error("another client shares the bucket")
+	}
+}
+
+func TestRateLimiterFull(t *testing.T) {
+	tests := []struct {
+		name  string
+		after time.Duration // since the table filled up
+		ok    bool
+		wait  time.Duration
+		size  int
+	}{
+		{"busy clients keep their buckets", 100 * time.Millisecond, false, time.Second, rateLimitMaxClients},
+		{"refilled buckets are forgotten", 2 * time.Second, true, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+			start := time.Now()
+			for i := 0; i < rateLimitMaxClients; i++ {
+				if ok, _ := l.allow(fmt.Sprintf("client-%d", i), 1, 1, start); !ok {
+					t.Fatalf("client %d refused while filling the table", i)
+				}
+			}
+			ok, wait := l.allow("newcomer", 1, 1, start.Add(tt.after))
+			if ok != tt.ok || wait != tt.wait {
+				t.Errorf("got %v, %s, want %v, %s", ok, wait, tt.ok, tt.wait)
+			}
+			if len(l.buckets) != tt.size {
+				t.Errorf("%d buckets, want %d", len(l.buckets), tt.size)
+			}
+		})
+	}
+}
+
+func TestIPAllowlist(t *testing.T) {
+	l := parseAllowlist([]string{"192.168.1.0/24", "10.0.0.5", "fd00::/8", "not an address"})
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.168.1.10:1234", true},
+		{"192.168.2.10:1234", false},
+		{"10.0.0.5:80", true},
+		{"10.0.0.6:80", false},
+		{"[::ffff:192.168.1.10]:1234", true},
+		{"[fd00::1%eth0]:1234", true},
+		{"[fe80::1]:1234", false},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.allows(addr); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if len(l) != 3 {
+		t.Errorf("parsed %d entries, want 3", len(l))
+	}
+	if !ipAllowlist(nil).allows(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Error("an empty list refuses")
+	}
+}
@@ -1,34 +1,71 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type ApiServer struct {
-	ApiPort             uint32
-	ServerTransactionID uint32
+	ApiPort       uint32
+	transactionID atomic.Uint32 // last ServerTransactionID handed out
+	server        *http.Server
 }
 
 func NewApiServer(apiPort uint32) *ApiServer {
 	return &ApiServer{
 		ApiPort: apiPort,
+		server:  &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", apiPort)},
 	}
 }
 
-func (srv *ApiServer) Start() {
+// Start serves the API until Shutdown is called, in which case it returns http.ErrServerClosed
+func (srv *ApiServer) Start() error {
 	router := httprouter.New()
 	srv.configureManagementAPI(router)
 	srv.configureCommonAPI(router)
 	srv.configureSwitchAPI(router)
+	srv.configureMetricsAPI(router)
+	srv.configureEventsAPI(router)
+	srv.configureRestAPI(router)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", srv.ApiPort), router))
+	srv.server.Handler = srv.correlate(srv.instrument(router, srv.authorize(srv.rateLimit(router))))
+	srv.server.RegisterOnShutdown(events.close)
+
+	c := s.tlsConfig().withDefaults()
+	var certs *certReloader
+	if c.enabled() {
+		var err error
+		if certs, err = newCertReloader(c); err != nil {
+			return err
+		}
+		srv.server.TLSConfig = certs.serverConfig()
+	}
+
+	ln, err := net.Listen("tcp", srv.server.Addr)
+	if err != nil {
+		return err
+	}
+	ln = allowListener{ln}
+	if certs == nil {
+		return srv.server.Serve(ln)
+	}
+	slog.Info("Serving the API over TLS", "cert", c.Cert, "expires", certs.cert.Leaf.NotAfter, "clientca", c.ClientCA)
+	return srv.server.ServeTLS(ln, "", "")
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests to finish or ctx to expire
+func (srv *ApiServer) Shutdown(ctx context.Context) error {
+	return srv.server.Shutdown(ctx)
 }
 
 func (srv *ApiServer) handleNotSupported(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -39,14 +76,44 @@ func (srv *ApiServer) handleNotSupported(w http.ResponseWriter, r *http.Request,
 	json.NewEncoder(w).Encode(resp)
 }
 
+// handleAlpacaError reports a device or driver error the Alpaca way: HTTP 200
+// with ErrorNumber and ErrorMessage set
+func (srv *ApiServer) handleAlpacaError(w http.ResponseWriter, r *http.Request, number int32, message string) {
+	resp := putResponse{}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	resp.ErrorNumber = number
+	resp.ErrorMessage = message
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (srv *ApiServer) prepareAlpacaResponse(r *http.Request, resp *alpacaResponse) {
 	ctid := getClientTransactionId(r)
 	if ctid < 0 {
 		ctid = 0
 	}
-	srv.ServerTransactionID++
+	stid, ok := r.Context().Value(transactionIDKey{}).(uint32)
+	if !ok {
+		stid = srv.nextTransactionID()
+	}
 	resp.ClientTransactionID = uint32(ctid)
-	resp.ServerTransactionID = srv.ServerTransactionID
+	resp.ServerTransactionID = stid
+}
+
+// transactionIDKey holds the ServerTransactionID assigned to a request
+type transactionIDKey struct{}
+
+func (srv *ApiServer) nextTransactionID() uint32 {
+	return srv.transactionID.Add(1)
+}
+
+// isAlpacaRequest reports whether r is for the Alpaca API, whose form
+// parameters carry the client and transaction ids. Other routes, such as the
+// REST API, have JSON bodies that must not be parsed as a form.
+func isAlpacaRequest(r *http.Request) bool {
+	p := r.URL.Path
+	return strings.HasPrefix(p, "/api/v1/") || strings.HasPrefix(p, "/management/") || strings.HasPrefix(p, "/setup/")
 }
 
 func (srv *ApiServer) validAlpacaRequest(r *http.Request) bool {
@@ -119,7 +186,7 @@ func getIdFromRequest(r *http.Request) (int32, error) {
 	if err != nil {
 		return -1, errors.New("id parameter not numeric")
 	}
-	if iid < 0 {
+	if iid < 0 || iid >= int64(MiGetMaxSwitch()) {
 		return -1, errors.New("id parameter out of range")
 	}
 	return int32(iid), nil
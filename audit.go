@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log is a JSON lines file next to state.json. When it grows past
+// auditMaxSize it is renamed to audit.jsonl.1 and older files move up, up to
+// auditFiles rotated files.
+const (
+	auditFile    = "audit.jsonl"
+	auditMaxSize = 1 << 20
+	auditFiles   = 5
+)
+
+// Audit sources
+const (
+	sourceAlpaca  = "alpaca"  // an Alpaca client
+	sourcePoller  = "poller"  // a change outside Alpaca seen by the background poller
+	sourceRefresh = "refresh" // a change outside Alpaca seen when connecting or reloading
+	sourceMQTT    = "mqtt"    // a command on an MQTT set topic
+	sourceREST    = "rest"    // a client of the REST API
+)
+
+// Results of a switch change
+const (
+	auditConfirmed   = "confirmed"   // the plug acknowledged the command
+	auditUnconfirmed = "unconfirmed" // the command was sent but the plug did not answer
+	auditFailed      = "failed"      // the command could not be delivered
+	auditObserved    = "observed"    // the plug reported a new value on its own
+)
+
+// auditSource says who or what changed a switch
+type auditSource struct {
+	Kind                string `json:"kind"`
+	ClientID            *int   `json:"clientid,omitempty"`
+	Remote              string `json:"remote,omitempty"`
+	ServerTransactionID uint32 `json:"servertransactionid,omitempty"`
+	User                string `json:"user,omitempty"` // authenticated user or token name
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time     time.Time   `json:"time"`
+	Switch   int32       `json:"switch"`
+	UniqueID string      `json:"uniqueid"`
+	Name     string      `json:"name"`
+	Old      int64       `json:"old"`
+	New      int64       `json:"new"`
+	Source   auditSource `json:"source"`
+	Result   string      `json:"result"`
+	Error    string      `json:"error,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+type auditSourceKey struct{}
+
+// withAuditSource returns a context whose switch changes are recorded as
+// made by src
+func withAuditSource(ctx context.Context, src auditSource) context.Context {
+	return context.WithValue(ctx, auditSourceKey{}, src)
+}
+
+func auditSourceFrom(ctx context.Context) auditSource {
+	if src, ok := ctx.Value(auditSourceKey{}).(auditSource); ok {
+		return src
+	}
+	return auditSource{Kind: "unknown"}
+}
+
+// newAuditEntry describes a change of switch i. The caller must hold sm.
+func newAuditEntry(i int32, d *Device, from, to int64, src auditSource) auditEntry {
+	return auditEntry{
+		Time:     time.Now(),
+		Switch:   i,
+		UniqueID: d.Uniqueid,
+		Name:     d.displayName(),
+		Old:      from,
+		New:      to,
+		Source:   src,
+	}
+}
+
+// auditFailure records a command to the switch with the given uniqueid
+// that did not reach the plug
+func (s *sw) auditFailure(ctx context.Context, uid string, state bool, err error) {
+	var to int64
+	if state {
+		to = 1
+	}
+	sm.RLock()
+	id := s.indexOf(uid)
+	if id < 0 {
+		sm.RUnlock()
+		return
+	}
+	e := newAuditEntry(id, &s.Devices[id], s.Devices[id].Value, to, auditSourceFrom(ctx))
+	sm.RUnlock()
+	e.Result = auditFailed
+	e.Error = err.Error()
+	auditRecord(e)
+}
+
+// auditRecord appends e to the audit log. A failure is logged but never
+// stops the switch change itself.
+func auditRecord(e auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("Cannot encode audit entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if fi, err := os.Stat(auditFile); err == nil && fi.Size()+int64(len(line)) > auditMaxSize {
+		if err := rotateAuditLog(); err != nil {
+			slog.Warn("Failed to rotate audit log", "error", err)
+		}
+	}
+	f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.Write(line)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to write audit log", "error", err)
+	}
+}
+
+func auditName(n int) string {
+	if n == 0 {
+		return auditFile
+	}
+	return fmt.Sprintf("%s.%d", auditFile, n)
+}
+
+// rotateAuditLog shifts the rotated files up by one, dropping the oldest,
+// and starts a new current file. The caller must hold auditMu.
+func rotateAuditLog() error {
+	for i := auditFiles - 1; i >= 0; i-- {
+		err := os.Rename(auditName(i), auditName(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditQuery selects audit entries. Zero times and an empty uniqueid match
+// everything. Switches are matched by uniqueid, as a switch id may have
+// belonged to another plug before a reload.
+type auditQuery struct {
+	Since, Until time.Time
+	UniqueID     string
+}
+
+func (q auditQuery) match(e auditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return q.UniqueID == "" || strings.EqualFold(e.UniqueID, q.UniqueID)
+}
+
+// readAuditLog returns the matching entries of the current and rotated
+// files, oldest first. Lines that do not parse, such as one torn by a crash,
+// are skipped.
+func readAuditLog(q auditQuery) ([]auditEntry, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	entries := []auditEntry{}
+	for i := auditFiles; i >= 0; i-- {
+		f, err := os.Open(auditName(i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e auditEntry
+			if json.Unmarshal(sc.Bytes(), &e) == nil && q.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
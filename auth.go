@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authConfig is the optional auth section of settings.json. Without users
+// and tokens the API stays open, as before.
+type authConfig struct {
+	Users  []authUser  `json:"users,omitempty"`  // HTTP Basic credentials
+	Tokens []authToken `json:"tokens,omitempty"` // bearer tokens
+	Certs  []authCert  `json:"certs,omitempty"`  // TLS client certificates, see tls.clientca
+	// AnonymousAlpaca is the role of Alpaca clients without credentials,
+	// such as NINA, on the routes they need; empty requires credentials for
+	// the Alpaca API too
+	AnonymousAlpaca string `json:"anonymousalpaca,omitempty"`
+}
+
+type authUser struct {
+	Name     string  `json:"name"`
+	Password string  `json:"password"` // plain, or pbkdf2-sha256:iterations:salt:hash from hash-password
+	Role     string  `json:"role"`
+	Switches []int32 `json:"switches,omitempty"` // switch ids this user may change; empty for all
+}
+
+type authToken struct {
+	Name     string  `json:"name"`
+	Token    string  `json:"token"` // plain, or pbkdf2-sha256:iterations:salt:hash from hash-password
+	Role     string  `json:"role"`
+	Switches []int32 `json:"switches,omitempty"`
+}
+
+// authCert gives the client certificates with common name Name a role
+type authCert struct {
+	Name     string  `json:"name"`
+	Role     string  `json:"role"`
+	Switches []int32 `json:"switches,omitempty"`
+}
+
+// Roles
+const (
+	roleReadOnly = "readonly" // may read everything
+	roleOperator = "operator" // may also change switches and the connected flag
+)
+
+// Hashed secrets are pbkdf2-sha256:iterations:salt:hash. The older
+// sha256:salt:hash form is still accepted so existing settings keep working
+// until they are hashed again.
+const (
+	pbkdf2SecretPrefix = "pbkdf2-sha256:"
+	legacySecretPrefix = "sha256:"
+
+	defaultPBKDF2Iterations = 600000
+	minPBKDF2Iterations     = 10000
+)
+
+// Failed logins allowed per client address, so wrong guesses cannot keep
+// the server busy deriving keys
+const (
+	authFailRate  = 1.0 // per second
+	authFailBurst = 10
+)
+
+var authFailLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func validRole(role string) bool {
+	return role == roleReadOnly || role == roleOperator
+}
+
+// enabled reports whether requests need credentials
+func (c *authConfig) enabled() bool {
+	return len(c.Users) > 0 || len(c.Tokens) > 0 || len(c.Certs) > 0
+}
+
+// anonymousAlpacaRoutes are the management routes an Alpaca client uses to
+// find the switch, besides /api/v1/ and /setup/
+var anonymousAlpacaRoutes = []string{
+	"/management/apiversions",
+	"/management/v1/description",
+	"/management/v1/configureddevices",
+}
+
+// isAnonymousAlpacaRequest reports whether r may be made without credentials
+// under auth.anonymousalpaca. The audit log and device health stay protected.
+func isAnonymousAlpacaRequest(r *http.Request) bool {
+	p := r.URL.Path
+	return strings.HasPrefix(p, "/api/v1/") || strings.HasPrefix(p, "/setup/") || slices.Contains(anonymousAlpacaRoutes, p)
+}
+
+// principal is who a request was authenticated as
+type principal struct {
+	name     string
+	role     string
+	switches []int32
+}
+
+// mayChange reports whether p may change switch id
+func (p *principal) mayChange(id int32) bool {
+	return p.role == roleOperator && (len(p.switches) == 0 || slices.Contains(p.switches, id))
+}
+
+// authenticate checks the credentials of r, trying a listed client
+// certificate first. It reports false when r carries
+// credentials that do not match, and a nil principal when it carries none.
+func (c *authConfig) authenticate(r *http.Request) (*principal, bool) {
+	// A client certificate has been verified against tls.clientca already
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, cc := range c.Certs {
+			if cc.Name == cn {
+				return &principal{name: cc.Name, role: cc.Role, switches: cc.Switches}, true
+			}
+		}
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		for _, u := range c.Users {
+			if subtle.ConstantTimeCompare([]byte(u.Name), []byte(name)) == 1 && checkSecret(u.Password, password) {
+				return &principal{name: u.Name, role: u.Role, switches: u.Switches}, true
+			}
+		}
+		return nil, false
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		for _, t := range c.Tokens {
+			if checkSecret(t.Token, strings.TrimSpace(token)) {
+				return &principal{name: t.Name, role: t.Role, switches: t.Switches}, true
+			}
+		}
+		return nil, false
+	}
+	return nil, true
+}
+
+// checkSecret compares a presented password or token with the configured
+// one in constant time
+func checkSecret(stored, given string) bool {
+	h, hashed, err := parseHashedSecret(stored)
+	if !hashed {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+	}
+	if err != nil {
+		return false
+	}
+	if verifiedSecrets.known(stored, given) {
+		return true
+	}
+	if subtle.ConstantTimeCompare(h.sum, h.derive(given)) != 1 {
+		return false
+	}
+	verifiedSecrets.add(stored, given)
+	return true
+}
+
+// hashedSecret is a parsed hashed password or token
+type hashedSecret struct {
+	iterations int // 0 for the legacy sha256 form
+	salt       []byte
+	sum        []byte
+}
+
+// parseHashedSecret parses a secret made by hash-password. It reports false
+// for a plain secret.
+func parseHashedSecret(stored string) (hashedSecret, bool, error) {
+	errFormat := errors.New("is not a hash made by hash-password")
+	if rest, ok := strings.CutPrefix(stored, pbkdf2SecretPrefix); ok {
+		parts := strings.Split(rest, ":")
+		if len(parts) != 3 {
+			return hashedSecret{}, true, errFormat
+		}
+		iter, err := strconv.Atoi(parts[0])
+		if err != nil || iter < minPBKDF2Iterations {
+			return hashedSecret{}, true, fmt.Errorf("needs at least %d iterations", minPBKDF2Iterations)
+		}
+		salt, err := hex.DecodeString(parts[1])
+		if err != nil || len(salt) == 0 {
+			return hashedSecret{}, true, errFormat
+		}
+		sum, err := hex.DecodeString(parts[2])
+		if err != nil || len(sum) != sha256.Size {
+			return hashedSecret{}, true, errFormat
+		}
+		return hashedSecret{iterations: iter, salt: salt, sum: sum}, true, nil
+	}
+	if rest, ok := strings.CutPrefix(stored, legacySecretPrefix); ok {
+		salt, hexSum, ok := strings.Cut(rest, ":")
+		sum, err := hex.DecodeString(hexSum)
+		if !ok || salt == "" || err != nil || len(sum) != sha256.Size {
+			return hashedSecret{}, true, errFormat
+		}
+		return hashedSecret{salt: []byte(salt), sum: sum}, true, nil
+	}
+	return hashedSecret{}, false, nil
+}
+
+// derive hashes secret the way h was made
+func (h hashedSecret) derive(secret string) []byte {
+	if h.iterations == 0 {
+		sum := sha256.Sum256([]byte(string(h.salt) + secret))
+		return sum[:]
+	}
+	return pbkdf2SHA256([]byte(secret), h.salt, h.iterations)
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256, giving one block of
+// 32 bytes
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := slices.Clone(u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// newHashedSecret returns the pbkdf2-sha256 form of secret for settings.json
+func newHashedSecret(secret string, iterations int) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := pbkdf2SHA256([]byte(secret), salt, iterations)
+	return fmt.Sprintf("%s%d:%s:%s", pbkdf2SecretPrefix, iterations, hex.EncodeToString(salt), hex.EncodeToString(sum)), nil
+}
+
+// secretCache remembers the secrets that matched a hashed one, so a client
+// that sends its password with every request pays for the key derivation
+// once. Only a sha256 of the secret is kept, and wrong guesses are never
+// cached, so guessing still costs the full derivation.
+type secretCache struct {
+	mu   sync.Mutex
+	sums map[string][sha256.Size]byte // by stored secret
+}
+
+// secretCacheMax bounds the cache across reloads that change the secrets
+const secretCacheMax = 256
+
+var verifiedSecrets = &secretCache{sums: make(map[string][sha256.Size]byte)}
+
+func (c *secretCache) known(stored, given string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum, ok := c.sums[stored]
+	want := sha256.Sum256([]byte(given))
+	return ok && subtle.ConstantTimeCompare(sum[:], want[:]) == 1
+}
+
+func (c *secretCache) add(stored, given string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sums) >= secretCacheMax {
+		clear(c.sums)
+	}
+	c.sums[stored] = sha256.Sum256([]byte(given))
+}
+
+// warnLegacySecrets logs the users and tokens still hashed the old way
+func (c *authConfig) warnLegacySecrets() {
+	for _, u := range c.Users {
+		if strings.HasPrefix(u.Password, legacySecretPrefix) {
+			slog.Warn("Password uses the old sha256 hash, hash it again with hash-password", "user", u.Name)
+		}
+	}
+	for _, t := range c.Tokens {
+		if strings.HasPrefix(t.Token, legacySecretPrefix) {
+			slog.Warn("Token uses the old sha256 hash, hash it again with hash-password", "token", t.Name)
+		}
+	}
+}
+
+func (s *sw) authConfig() authConfig {
+	sm.RLock()
+	defer sm.RUnlock()
+	return s.auth
+}
+
+// authorize lets a request through when its credentials allow it. Reading
+// needs any role, changing needs operator, and changing a switch needs a
+// principal that may change that switch. The routes Alpaca clients need can
+// be left open to clients without credentials with auth.anonymousalpaca.
+// Each request with credentials takes a token from its address's bucket of
+// failed logins before they are checked and gives it back when they match,
+// so an address that keeps guessing gets 429 without a key derivation.
+func (srv *ApiServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.authConfig()
+		if !c.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientHost(r.RemoteAddr)
+		hasCredentials := r.Header.Get("Authorization") != ""
+		if hasCredentials {
+			if ok, wait := authFailLimiter.allow(key, authFailRate, authFailBurst, time.Now()); !ok {
+				retry := setRetryAfter(w, wait)
+				loggerFrom(r.Context()).Warn("Too many failed logins", "client", key, "retry", retry)
+				http.Error(w, fmt.Sprintf("too many failed logins, retry in %ds", retry), http.StatusTooManyRequests)
+				return
+			}
+		}
+		p, valid := c.authenticate(r)
+		if !valid {
+			denyUnauthenticated(w, "invalid credentials")
+			return
+		}
+		if hasCredentials {
+			authFailLimiter.refund(key, authFailBurst)
+		}
+		if p == nil {
+			if c.AnonymousAlpaca == "" || !isAnonymousAlpacaRequest(r) {
+				denyUnauthenticated(w, "authentication required")
+				return
+			}
+			p = &principal{name: "anonymous", role: c.AnonymousAlpaca}
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if p.role != roleOperator {
+				http.Error(w, "read-only access", http.StatusForbidden)
+				return
+			}
+			if id, ok := requestSwitchID(r); ok && !p.mayChange(id) {
+				http.Error(w, fmt.Sprintf("no permission to change switch %d", id), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := r.Context()
+		src := auditSourceFrom(ctx)
+		src.User = p.name
+		ctx = withAuditSource(ctx, src)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("user", p.name))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func denyUnauthenticated(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="mi_alpaca"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// requestSwitchID returns the switch a request is about, from the path of
+// the REST API or the Id parameter of the Alpaca switch API
+func requestSwitchID(r *http.Request) (int32, bool) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/v1/switches/"); ok {
+		idv, _, _ := strings.Cut(rest, "/")
+		id, err := strconv.ParseInt(idv, 10, 32)
+		return int32(id), err == nil
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/v1/switch/") {
+		id, err := getIdFromRequest(r)
+		return id, err == nil
+	}
+	return 0, false
+}
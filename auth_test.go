@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors from RFC 7914 section 11
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+// legacySecret returns secret in the old sha256:salt:hash form
+func legacySecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return legacySecretPrefix + salt + ":" + hex.EncodeToString(sum[:])
+}
+
+func TestCheckSecret(t *testing.T) {
+	hashed, err := newHashedSecret("correct horse", minPBKDF2Iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := strings.Split(hashed, ":")[2]
+	sum := strings.Repeat("00", sha256.Size)
+	tests := []struct {
+		name   string
+		stored string
+		given  string
+		want   bool
+	}{
+		{"plain", "guest", "guest", true},
+		{"plain wrong", "guest", "Guest", false},
+		{"plain empty", "guest", "", false},
+		{"pbkdf2", hashed, "correct horse", true},
+		{"pbkdf2 again from the cache", hashed, "correct horse", true},
+		{"pbkdf2 wrong", hashed, "correct horse ", false},
+		{"pbkdf2 hash given as the secret", hashed, hashed, false},
+		{"legacy", legacySecret("pepper", "hunter2"), "hunter2", true},
+		{"legacy wrong", legacySecret("pepper", "hunter2"), "hunter3", false},
+		{"pbkdf2 too few iterations", fmt.Sprintf("pbkdf2-sha256:%d:%s:%s", minPBKDF2Iterations-1, salt, sum), "", false},
+		{"pbkdf2 missing hash", "pbkdf2-sha256:10000:" + salt, "", false},
+		{"legacy short hash", "sha256:pepper:abcd", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkSecret(tt.stored, tt.given); got != tt.want {
+				t.Errorf("checkSecret(%q, %q) = %v, want %v", tt.stored, tt.given, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHashedSecret(t *testing.T) {
+	salt := strings.Repeat("ab", 16)
+	sum := strings.Repeat("cd", sha256.Size)
+	tests := []struct {
+		stored     string
+		hashed     bool
+		iterations int
+		wantErr    bool
+	}{
+		{"plain secret", false, 0, false},
+		{"pbkdf2-sha256:600000:" + salt + ":" + sum, true, 600000, false},
+		{"pbkdf2-sha256:10000:" + salt + ":" + sum, true, 10000, false},
+		{"pbkdf2-sha256:9999:" + salt + ":" + sum, true, 0, true},
+		{"pbkdf2-sha256:many:" + salt + ":" + sum, true, 0, true},
+		{"pbkdf2-sha256:600000::" + sum, true, 0, true},
+		{"pbkdf2-sha256:600000:xyz:" + sum, true, 0, true},
+		{"pbkdf2-sha256:600000:" + salt + ":" + sum[2:], true, 0, true},
+		{"pbkdf2-sha256:600000:" + salt + ":" + sum + ":", true, 0, true},
+		{"sha256:pepper:" + sum, true, 0, false},
+		{"sha256::" + sum, true, 0, true},
+		{"sha256:pepper", true, 0, true},
+	}
+	for _, tt := range tests {
+		h, hashed, err := parseHashedSecret(tt.stored)
+		if hashed != tt.hashed || (err != nil) != tt.wantErr || h.iterations != tt.iterations {
+			t.Errorf("parseHashedSecret(%q) = %d iterations, %v, %v, want %d, %v, error %v",
+				tt.stored, h.iterations, hashed, err, tt.iterations, tt.hashed, tt.wantErr)
+		}
+	}
+}
+
+// TestAuthorizeFailedLogins checks that an address guessing credentials is
+// refused before they are checked, and that the Bearer scheme is matched
+// without regard to case
+func TestAuthorizeFailedLogins(t *testing.T) {
+	hashed, err := newHashedSecret("s3cret", minPBKDF2Iterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := fmt.Sprintf(`"auth": {"tokens": [{"name": "agent", "token": %q, "role": "operator"}]}`, hashed)
+	useTestSettings(t, testSettings("Plug", []string{"127.0.0.41"}, auth))
+	authFailLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	t.Cleanup(func() { authFailLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)} })
+
+	h := (&ApiServer{}).authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remote, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/switches", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	type step struct {
+		name          string
+		remote        string
+		authorization string
+		want          int
+	}
+	steps := []step{
+		{"right token", "192.168.1.10:1000", "Bearer s3cret", http.StatusOK},
+		{"scheme in lower case", "192.168.1.10:1000", "bearer s3cret", http.StatusOK},
+		{"scheme in upper case", "192.168.1.10:1000", "BEARER s3cret", http.StatusOK},
+		{"no credentials", "192.168.1.10:1000", "", http.StatusUnauthorized},
+	}
+	for i := 0; i < authFailBurst; i++ {
+		steps = append(steps, step{fmt.Sprintf("guess %d", i+1), "192.168.1.10:1000", "Bearer guess", http.StatusUnauthorized})
+	}
+	steps = append(steps,
+		step{"guess over the limit", "192.168.1.10:1001", "Bearer guess", http.StatusTooManyRequests},
+		step{"right token over the limit", "192.168.1.10:1002", "Bearer s3cret", http.StatusTooManyRequests},
+		step{"another address", "192.168.1.11:1000", "Bearer guess", http.StatusUnauthorized},
+	)
+
+	for _, st := range steps {
+		w := get(st.remote, st.authorization)
+		if w.Code != st.want {
+			t.Fatalf("%s: status %d, want %d", st.name, w.Code, st.want)
+		}
+		if st.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: Retry-After %q, want 1", st.name, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand runs a command line subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "discover":
+		return cmdDiscover(args)
+	case "validate-config":
+		return cmdValidateConfig(args)
+	case "encrypt-tokens":
+		return cmdEncryptTokens(args)
+	case "import":
+		return cmdImport(args)
+	case "hash-password":
+		return cmdHashPassword(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		fmt.Fprintln(os.Stderr, "usage: mi_alpaca [discover | validate-config [file] | encrypt-tokens [-genkey keyfile] [file] | import [-format f] [-o file] export | hash-password [-iterations n]]")
+		return 2
+	}
+}
+
+// cmdDiscover lists the Alpaca servers and devices found on the network
+func cmdDiscover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "time to wait for discovery replies")
+	asJSON := fs.Bool("json", false, "print the inventory as JSON")
+	fs.Parse(args)
+
+	servers, err := DiscoverAlpacaServers(*timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "discovery failed: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		enc.Encode(servers)
+		return 0
+	}
+
+	if len(servers) == 0 {
+		fmt.Println("No Alpaca servers found")
+		return 0
+	}
+	for _, srv := range servers {
+		addr := net.JoinHostPort(srv.Address, fmt.Sprint(srv.Port))
+		if srv.Error != "" {
+			fmt.Printf("%s  (error: %s)\n", addr, srv.Error)
+			continue
+		}
+		fmt.Printf("%s  %s, %s %s, %s\n", addr, srv.Description.ServerName,
+			srv.Description.Manufacturer, srv.Description.ManufacturerVersion, srv.Description.Location)
+		for _, d := range srv.Devices {
+			fmt.Printf("    %s %d  %s  %s\n", d.DeviceType, d.DeviceNumber, d.DeviceName, d.UniqueID)
+		}
+	}
+	return 0
+}
+
+// cmdValidateConfig checks a settings file and reports every problem found
+func cmdValidateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	fs.Parse(args)
+
+	path := settingsFile
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	cfg, errs := validateConfigFile(path)
+	if errs != nil {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
+	}
+	fmt.Printf("%s: OK, %d devices\n", path, len(cfg.Devices))
+	return 0
+}
+
+// cmdEncryptTokens rewrites a settings file with every plain token encrypted
+func cmdEncryptTokens(args []string) int {
+	fs := flag.NewFlagSet("encrypt-tokens", flag.ExitOnError)
+	genkey := fs.String("genkey", "", "create a new random key in this file and use it")
+	fs.Parse(args)
+
+	path := settingsFile
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	var key []byte
+	var err error
+	if *genkey != "" {
+		key, err = newTokenKey(*genkey)
+		if err == nil {
+			os.Setenv(keyFileEnv, *genkey)
+			fmt.Printf("Created key file %s; set %s=%s when running the server\n", *genkey, keyFileEnv, *genkey)
+		}
+	} else {
+		key, err = loadTokenKey()
+		if err == nil && key == nil {
+			err = fmt.Errorf("no key: set %s or %s, or pass -genkey", keyEnv, keyFileEnv)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if _, errs := validateConfigFile(path); errs != nil {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Only the token strings change, so the rest of the file keeps its
+	// sections and formatting
+	tokens := make(map[int]deviceToken)
+	for i, d := range cfg.Devices {
+		if d.Token.encrypted() {
+			continue
+		}
+		if tokens[i], err = d.Token.encrypt(key); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if len(tokens) > 0 {
+		if data, err = replaceTokens(data, tokens); err == nil {
+			err = writeFileAtomic(path, data, 0600)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	fmt.Printf("%s: encrypted %d tokens\n", path, len(tokens))
+	return 0
+}
+
+// cmdImport builds a settings file from a python-miio, Home Assistant or CSV export
+func cmdImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", importAuto, "export format: auto, miio, miio-json, ha or csv")
+	out := fs.String("o", settingsFile, "settings file to write")
+	force := fs.Bool("force", false, "overwrite the settings file if it exists")
+	all := fs.Bool("all", false, "import every device, not only plugs and switches")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: mi_alpaca import [-format f] [-o file] [-force] [-all] export")
+		return 2
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -force to overwrite it\n", *out)
+		return 1
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	imported, err := parseImport(fs.Arg(0), data, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var keep []importedDevice
+	for _, d := range imported {
+		switch {
+		case d.IP == "" || d.Token == "":
+			fmt.Fprintf(os.Stderr, "skipping %q: no IP address or token\n", d.Name)
+		case !*all && !isSwitchModel(d.Model):
+			fmt.Fprintf(os.Stderr, "skipping %q: model %s is not a plug or switch (use -all to include it)\n", d.Name, d.Model)
+		default:
+			keep = append(keep, d)
+		}
+	}
+
+	// A wrong export must not replace a working settings file with an empty one
+	if len(keep) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no devices to import, %s not written\n", fs.Arg(0), *out)
+		return 1
+	}
+
+	cfg, err := buildConfig(keep)
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(&cfg, "", "    "); err == nil {
+			err = writeFileAtomic(*out, data, 0600)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: imported %d devices\n", *out, len(cfg.Devices))
+
+	// Point out anything the export got wrong, such as a short token
+	if _, errs := validateConfigFile(*out); errs != nil {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
+	}
+	return 0
+}
+
+// cmdHashPassword reads a password or token from stdin and prints the hashed
+// form to use in the auth section of settings.json
+func cmdHashPassword(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	iterations := fs.Int("iterations", defaultPBKDF2Iterations, "PBKDF2 iterations; more are slower to check and to guess")
+	fs.Parse(args)
+	if *iterations < minPBKDF2Iterations {
+		fmt.Fprintf(os.Stderr, "-iterations must be at least %d\n", minPBKDF2Iterations)
+		return 2
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	secret := strings.TrimRight(line, "\r\n")
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "usage: echo password | mi_alpaca hash-password")
+		return 2
+	}
+	hashed, err := newHashedSecret(secret, *iterations)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hashed)
+	return 0
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (srv *ApiServer) configureCommonAPI(router *httprouter.Router) {
 	// ASCOM Methods Common To All Devices
-	router.PUT("/api/v1/switch/1/action", srv.handleNotSupported)
+	router.PUT("/api/v1/switch/1/action", srv.handleAction)
 	router.PUT("/api/v1/switch/1/commandblind", srv.handleNotSupported)
 	router.PUT("/api/v1/switch/1/commandbool", srv.handleNotSupported)
 	router.PUT("/api/v1/switch/1/commandstring", srv.handleNotSupported)
@@ -51,7 +54,14 @@ func (srv *ApiServer) handleConnect(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
-	MiSetConnect(connected)
+	if err := MiSetConnect(connected); err != nil {
+		resp := stringResponse{Value: err.Error()}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 
 	resp := stringResponse{Value: ""}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
@@ -60,6 +70,37 @@ func (srv *ApiServer) handleConnect(w http.ResponseWriter, r *http.Request, ps h
 	json.NewEncoder(w).Encode(resp)
 }
 
+// actionDeviceHealth returns the health of all switches, or of the switch
+// whose id is given as the parameter, as a JSON string
+const actionDeviceHealth = "DeviceHealth"
+
+// Runs a custom action
+func (srv *ApiServer) handleAction(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	action := r.PostFormValue("Action")
+	if !strings.EqualFold(action, actionDeviceHealth) {
+		srv.handleAlpacaError(w, r, errActionNotImplemented, fmt.Sprintf("action %q is not supported", action))
+		return
+	}
+
+	var value interface{} = MiGetHealth()
+	if p := strings.TrimSpace(r.PostFormValue("Parameters")); p != "" {
+		id, err := strconv.Atoi(p)
+		health := MiGetHealth()
+		if err != nil || id < 0 || id >= len(health) {
+			srv.handleAlpacaError(w, r, errInvalidValue, fmt.Sprintf("invalid switch id %q", p))
+			return
+		}
+		value = health[id]
+	}
+	data, _ := json.Marshal(value)
+
+	resp := stringResponse{Value: string(data)}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
 // Returns the description of the device
 func (srv *ApiServer) handleDescriptionCommon(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	resp := stringResponse{Value: "Xiaomi Mi Smart Plug Switch Controller"}
@@ -106,9 +147,9 @@ func (srv *ApiServer) handleName(w http.ResponseWriter, r *http.Request, ps http
 	json.NewEncoder(w).Encode(resp)
 }
 
-// Returns the list of supported actions (none for this driver)
+// Returns the list of supported custom actions
 func (srv *ApiServer) handleSupportedActions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	resp := stringlistResponse{Value: []string{}}
+	resp := stringlistResponse{Value: []string{actionDeviceHealth}}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -1,19 +1,38 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Implementation of ASCOM Alpaca discovery protocol
 // https://raw.githubusercontent.com/ASCOMInitiative/ASCOMRemote/main/Documentation/ASCOM%20Alpaca%20API%20Reference.pdf
 
+// DiscoveryMulticastIPv6 is the link-local multicast group Alpaca clients use for IPv6 discovery
+const DiscoveryMulticastIPv6 = "ff12::a1:9aca"
+
+const (
+	discoveryReplyInterval = time.Second            // minimum time between replies to one source
+	discoveryMaxSources    = 1024                   // sources remembered by the reply limiter
+	discoveryErrorBackoff  = 100 * time.Millisecond // pause after a failed read
+)
+
 type DiscoveryServer struct {
 	Conn         net.PacketConn
+	Conn6        net.PacketConn
 	ApiPort      uint32
+	ListenPort   uint32
 	ListenString string
+	mu           sync.Mutex
+	closed       atomic.Bool
+	limiter      *replyLimiter
 }
 
 func NewDiscoveryServer(listenPort uint32, apiPort uint32) *DiscoveryServer {
@@ -25,7 +44,9 @@ func NewDiscoveryServer(listenPort uint32, apiPort uint32) *DiscoveryServer {
 	}
 	return &DiscoveryServer{
 		ApiPort:      apiPort,
+		ListenPort:   listenPort,
 		ListenString: fmt.Sprintf("%s:%d", ListenIP, listenPort),
+		limiter:      newReplyLimiter(discoveryReplyInterval),
 	}
 }
 
@@ -33,36 +54,180 @@ func NewDiscoveryServer(listenPort uint32, apiPort uint32) *DiscoveryServer {
 func (s *DiscoveryServer) Start() {
 	udpServer, err := net.ListenPacket("udp", s.ListenString)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Cannot start discovery server", "error", err)
+		os.Exit(1)
+	}
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		udpServer.Close()
+		return
 	}
 	s.Conn = udpServer
-	defer s.Close()
+	s.mu.Unlock()
+	defer udpServer.Close()
+
+	s.serve(udpServer)
+}
+
+// StartIPv6 joins the Alpaca IPv6 multicast group on every multicast capable
+// interface and answers discovery packets received there. A single socket
+// joins the group on all interfaces: on Linux every socket bound to the
+// group receives its packets from every interface, so one socket per
+// interface would answer each request several times. Hosts without IPv6
+// are logged and skipped rather than treated as fatal.
+func (s *DiscoveryServer) StartIPv6() {
+	group := &net.UDPAddr{IP: net.ParseIP(DiscoveryMulticastIPv6), Port: int(s.ListenPort)}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Warn("IPv6 discovery disabled", "error", err)
+		return
+	}
+
+	var conn *net.UDPConn
+	for i := range ifaces {
+		ifi := ifaces[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if conn == nil {
+			conn, err = net.ListenMulticastUDP("udp6", &ifi, group)
+		} else {
+			err = joinIPv6Group(conn, &ifi, group.IP)
+		}
+		if err != nil {
+			slog.Debug("IPv6 discovery not available", "interface", ifi.Name, "error", err)
+			continue
+		}
+		slog.Info("IPv6 discovery listening", "group", DiscoveryMulticastIPv6, "interface", ifi.Name, "port", s.ListenPort)
+	}
+	if conn == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.Conn6 = conn
+	s.mu.Unlock()
+	defer conn.Close()
 
+	s.serve(conn)
+}
+
+// serve reads discovery packets from conn until the server is closed
+func (s *DiscoveryServer) serve(conn net.PacketConn) {
+	buf := make([]byte, 1024)
 	for {
-		buf := make([]byte, 1024)
-		_, addr, err := udpServer.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if s.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Discovery read error", "error", err)
+			time.Sleep(discoveryErrorBackoff)
 			continue
 		}
-		log.Printf("Received discovery packet from %s", addr)
-		msg := string(buf)
-		// Only handle and reply to alpacadiscovery1 packets
-		if strings.HasPrefix(msg, "alpacadiscovery1") {
-			go s.handleDiscoveryPacket(addr)
+		if !allowDiscovery(addr) {
+			metricDiscoveryPackets.inc("denied")
+			continue
 		}
+		version, ok := parseDiscoveryPacket(buf[:n])
+		if !ok {
+			metricDiscoveryPackets.inc("invalid")
+			continue
+		}
+		if !s.limiter.allow(addr, time.Now()) {
+			metricDiscoveryPackets.inc("ratelimited")
+			continue
+		}
+		metricDiscoveryPackets.inc("replied")
+		slog.Debug("Received discovery packet", "version", version, "from", addr.String())
+		s.handleDiscoveryPacket(conn, addr)
+	}
+}
+
+// parseDiscoveryPacket checks that b is exactly "alpacadiscovery" followed by
+// a single version digit and returns that version. Every version from 1 up is
+// answered with our version 1 reply as the protocol requires.
+func parseDiscoveryPacket(b []byte) (int, bool) {
+	const prefix = "alpacadiscovery"
+	if len(b) != len(prefix)+1 || string(b[:len(prefix)]) != prefix {
+		return 0, false
+	}
+	v := b[len(prefix)]
+	if v < '1' || v > '9' {
+		return 0, false
 	}
+	return int(v - '0'), true
 }
 
-func (s *DiscoveryServer) composeDiscoveryReply() string {
-	return fmt.Sprintf("{\n\"AlpacaPort\":%d\n}", s.ApiPort)
+func (s *DiscoveryServer) composeDiscoveryReply() []byte {
+	reply, _ := json.Marshal(discoveryReply{AlpacaPort: s.ApiPort})
+	return reply
 }
 
 // handleDiscoveryPacket sends the discovery response with the API port
-func (s *DiscoveryServer) handleDiscoveryPacket(addr net.Addr) {
-	log.Printf("Sending discovery response to %s", addr)
-	s.Conn.WriteTo([]byte(s.composeDiscoveryReply()), addr)
+func (s *DiscoveryServer) handleDiscoveryPacket(conn net.PacketConn, addr net.Addr) {
+	slog.Debug("Sending discovery response", "to", addr.String())
+	if _, err := conn.WriteTo(s.composeDiscoveryReply(), addr); err != nil {
+		slog.Warn("Discovery reply failed", "to", addr.String(), "error", err)
+	}
 }
 
+// replyLimiter allows at most one discovery reply per source address per
+// interval so the server cannot be used to reflect traffic at a victim
+type replyLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newReplyLimiter(interval time.Duration) *replyLimiter {
+	return &replyLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+func (l *replyLimiter) allow(addr net.Addr, now time.Time) bool {
+	key := addr.String()
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		key = udp.IP.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.interval {
+		return false
+	}
+	// Forget stale sources so the map cannot grow without bound
+	if len(l.last) >= discoveryMaxSources {
+		for k, t := range l.last {
+			if now.Sub(t) >= l.interval {
+				delete(l.last, k)
+			}
+		}
+		if len(l.last) >= discoveryMaxSources {
+			return false
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// Close stops all listeners and makes their read loops return
 func (s *DiscoveryServer) Close() {
-	s.Conn.Close()
+	s.closed.Store(true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+	if s.Conn6 != nil {
+		s.Conn6.Close()
+	}
+	s.Conn = nil
+	s.Conn6 = nil
 }
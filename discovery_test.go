@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDiscoveryPacket(t *testing.T) {
+	tests := []struct {
+		packet  string
+		version int
+		ok      bool
+	}{
+		{"alpacadiscovery1", 1, true},
+		{"alpacadiscovery2", 2, true},
+		{"alpacadiscovery9", 9, true},
+		{"alpacadiscovery0", 0, false},
+		{"alpacadiscovery", 0, false},
+		{"alpacadiscoveryx", 0, false},
+		{"alpacadiscovery10", 0, false},
+		{"alpacadiscovery1\x00", 0, false},
+		{"alpacadiscovery1\n", 0, false},
+		{"Alpacadiscovery1", 0, false},
+		{"xalpacadiscovery1", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		v, ok := parseDiscoveryPacket([]byte(tt.packet))
+		if v != tt.version || ok != tt.ok {
+			t.Errorf("parseDiscoveryPacket(%q) = %d, %v, want %d, %v", tt.packet, v, ok, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestReplyLimiter(t *testing.T) {
+	l := newReplyLimiter(time.Second)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 1000}
+	samehost := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 2000}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.1.11"), Port: 1000}
+
+	steps := []struct {
+		addr *net.UDPAddr
+		at   time.Duration
+		want bool
+	}{
+		{a, 0, true},
+		{a, 500 * time.Millisecond, false},
+		{samehost, 500 * time.Millisecond, false}, // limited by IP, not port
+		{b, 500 * time.Millisecond, true},
+		{a, time.Second, true},
+	}
+	for i, st := range steps {
+		if got := l.allow(st.addr, now.Add(st.at)); got != st.want {
+			t.Errorf("step %d: allow(%s) at %s = %v, want %v", i, st.addr, st.at, got, st.want)
+		}
+	}
+}
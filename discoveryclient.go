@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlpacaServer is an Alpaca server found on the network together with the
+// devices it reports through its management API
+type AlpacaServer struct {
+	Address     string                `json:"Address"`
+	Port        uint32                `json:"Port"`
+	Description *ServerDescription    `json:"Description,omitempty"`
+	Devices     []DeviceConfiguration `json:"Devices"`
+	Error       string                `json:"Error,omitempty"`
+}
+
+// discoveryReply is the JSON body of an Alpaca discovery response
+type discoveryReply struct {
+	AlpacaPort uint32 `json:"AlpacaPort"`
+}
+
+// DiscoverAlpacaServers broadcasts an alpacadiscovery1 packet, collects the
+// replies for the given time and queries each responding server for its
+// description and configured devices
+func DiscoverAlpacaServers(timeout time.Duration) ([]AlpacaServer, error) {
+	found, err := collectDiscoveryReplies(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	var wg sync.WaitGroup
+	for i := range found {
+		wg.Add(1)
+		go func(srv *AlpacaServer) {
+			defer wg.Done()
+			srv.query(client)
+		}(&found[i])
+	}
+	wg.Wait()
+	return found, nil
+}
+
+// collectDiscoveryReplies sends the discovery packet over IPv4 broadcast and
+// IPv6 multicast and returns one entry per distinct address and port
+func collectDiscoveryReplies(timeout time.Duration) ([]AlpacaServer, error) {
+	conn4, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn4.Close()
+
+	msg := []byte("alpacadiscovery1")
+	for _, ip := range broadcastAddresses() {
+		if _, err := conn4.WriteTo(msg, &net.UDPAddr{IP: ip, Port: DiscoveryPort}); err != nil {
+			slog.Debug("Discovery broadcast failed", "to", ip.String(), "error", err)
+		}
+	}
+
+	conns := []net.PacketConn{conn4}
+	if conn6, err := net.ListenPacket("udp6", "[::]:0"); err == nil {
+		defer conn6.Close()
+		conns = append(conns, conn6)
+		ifaces, _ := net.Interfaces()
+		for _, ifi := range ifaces {
+			if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+				continue
+			}
+			conn6.WriteTo(msg, &net.UDPAddr{IP: net.ParseIP(DiscoveryMulticastIPv6), Port: DiscoveryPort, Zone: ifi.Name})
+		}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var found []AlpacaServer
+
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.PacketConn) {
+			defer wg.Done()
+			c.SetReadDeadline(deadline)
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := c.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				var reply discoveryReply
+				if err := json.Unmarshal(buf[:n], &reply); err != nil || reply.AlpacaPort == 0 {
+					continue
+				}
+				host := addr.(*net.UDPAddr).IP.String()
+				if zone := addr.(*net.UDPAddr).Zone; zone != "" {
+					host += "%" + zone
+				}
+				key := net.JoinHostPort(host, fmt.Sprint(reply.AlpacaPort))
+				mu.Lock()
+				if !seen[key] {
+					seen[key] = true
+					found = append(found, AlpacaServer{Address: host, Port: reply.AlpacaPort})
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Address != found[j].Address {
+			return found[i].Address < found[j].Address
+		}
+		return found[i].Port < found[j].Port
+	})
+	return found, nil
+}
+
+// broadcastAddresses returns the limited broadcast address, the directed
+// broadcast address of every IPv4 interface and the loopback address so that
+// a server bound to localhost is found as well
+func broadcastAddresses() []net.IP {
+	addrs := []net.IP{net.IPv4bcast, net.IPv4(127, 0, 0, 1)}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifaddrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			bcast := make(net.IP, 4)
+			for i := range ip {
+				bcast[i] = ip[i] | ^ipnet.Mask[len(ipnet.Mask)-4+i]
+			}
+			addrs = append(addrs, bcast)
+		}
+	}
+	return addrs
+}
+
+// query fills in the description and devices of a discovered server
+func (srv *AlpacaServer) query(client *http.Client) {
+	// The zone of a link-local IPv6 address must be escaped inside a URL
+	host := strings.Replace(srv.Address, "%", "%25", 1)
+	base := "http://" + net.JoinHostPort(host, fmt.Sprint(srv.Port))
+
+	var desc managementDescriptionResponse
+	if err := getAlpacaJSON(client, base+"/management/v1/description", &desc); err != nil {
+		srv.Error = err.Error()
+		return
+	}
+	srv.Description = &desc.Value
+
+	var devices managementDevicesListResponse
+	if err := getAlpacaJSON(client, base+"/management/v1/configureddevices", &devices); err != nil {
+		srv.Error = err.Error()
+		return
+	}
+	srv.Devices = devices.Value
+}
+
+// getAlpacaJSON performs an Alpaca GET request and decodes the JSON response
+func getAlpacaJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url + "?ClientID=1&ClientTransactionID=1")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
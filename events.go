@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// eventKeepAlive is how often an idle event stream gets a comment line, so
+// proxies and clients do not time it out
+const eventKeepAlive = 30 * time.Second
+
+// eventBuffer is how many events a slow client may fall behind before it is
+// dropped; browsers reconnect and get the current state replayed
+const eventBuffer = 64
+
+// stateEvent is one Server-Sent Event, encoded when it is published
+type stateEvent struct {
+	name  string
+	data  []byte
+	state *switchState // the decoded data of a "switch" event
+}
+
+// switchState is the data of a "switch" event
+type switchState struct {
+	Id       uint32 `json:"id"`
+	UniqueID string `json:"uniqueid"`
+	Name     string `json:"name"`
+	Model    string `json:"model,omitempty"`
+	Value    int64  `json:"value"`
+	CanWrite bool   `json:"canwrite"`
+	Online   bool   `json:"online"`
+}
+
+func newSwitchEvent(d *Device) stateEvent {
+	st := &switchState{
+		Id:       d.Id,
+		UniqueID: d.Uniqueid,
+		Name:     d.displayName(),
+		Model:    d.Model,
+		Value:    d.Value,
+		CanWrite: d.Canwrite,
+		Online:   !d.health.offline,
+	}
+	data, _ := json.Marshal(st)
+	return stateEvent{name: "switch", data: data, state: st}
+}
+
+func newConnectedEvent(connected bool) stateEvent {
+	data, _ := json.Marshal(struct {
+		Connected bool `json:"connected"`
+	}{connected})
+	return stateEvent{name: "connected", data: data}
+}
+
+// eventBroker fans state changes out to the connected event streams.
+// Changes are published while sm is held, so a subscriber that takes its
+// snapshot under sm neither misses nor repeats a change.
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan stateEvent]struct{}
+	closed bool
+}
+
+var events = &eventBroker{subs: make(map[chan stateEvent]struct{})}
+
+// publish sends e to every subscriber. One that is too far behind is
+// dropped rather than holding up the caller.
+func (b *eventBroker) publish(e stateEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan stateEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan stateEvent, eventBuffer)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan stateEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every stream, so a server shutdown does not wait for them
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// subscribeEvents returns a new subscription together with events that
+// describe the current state
+func subscribeEvents() (chan stateEvent, []stateEvent) {
+	sm.RLock()
+	defer sm.RUnlock()
+	replay := []stateEvent{newConnectedEvent(s.Connected)}
+	for i := range s.Devices {
+		replay = append(replay, newSwitchEvent(&s.Devices[i]))
+	}
+	return events.subscribe(), replay
+}
+
+// configureEventsAPI sets up the event stream route
+func (srv *ApiServer) configureEventsAPI(router *httprouter.Router) {
+	router.GET("/api/events", srv.handleEvents)
+}
+
+// handleEvents streams switch and connection changes as Server-Sent Events,
+// starting with the current state
+func (srv *ApiServer) handleEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ch, replay := subscribeEvents()
+	defer events.unsubscribe(ch)
+	for _, e := range replay {
+		writeEvent(w, e)
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e stateEvent) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errSwitchOffline is returned for reads of an offline switch when
+// poll.offlineerror is set
+var errSwitchOffline = errors.New("switch is offline, its last known value may be stale")
+
+// deviceHealth tracks how a switch has been answering its queries and commands
+type deviceHealth struct {
+	offline             bool // set after poll.OfflineAfter consecutive failures
+	lastSeen            time.Time
+	lastError           string
+	lastErrorTime       time.Time
+	consecutiveFailures int
+	rtt                 time.Duration // round trip of the last successful exchange
+}
+
+// recordHealth updates the health after an exchange with the plug and logs
+// when the switch goes offline or comes back. quiet suppresses repeated
+// failure messages while a switch stays unreachable. The caller must hold sm.
+func (d *Device) recordHealth(rtt time.Duration, err error, offlineAfter int, quiet bool) {
+	h := &d.health
+	now := time.Now()
+	if err != nil {
+		h.consecutiveFailures++
+		h.lastError = err.Error()
+		h.lastErrorTime = now
+		if !quiet || h.consecutiveFailures <= 1 {
+			slog.Warn("Device did not answer", "device", d, "error", err)
+		}
+		if !h.offline && offlineAfter > 0 && h.consecutiveFailures >= offlineAfter {
+			h.offline = true
+			slog.Warn("Device is offline", "device", d, "failures", h.consecutiveFailures)
+			events.publish(newSwitchEvent(d))
+		}
+		return
+	}
+
+	h.consecutiveFailures = 0
+	h.lastSeen = now
+	h.rtt = rtt
+	if h.offline {
+		h.offline = false
+		slog.Info("Device is back online", "device", d)
+		events.publish(newSwitchEvent(d))
+	}
+}
+
+// view returns the exported form of the health of switch i
+func (h *deviceHealth) view(i int32, name string) DeviceHealth {
+	v := DeviceHealth{
+		Id:                  i,
+		Name:                name,
+		Online:              !h.offline,
+		LastError:           h.lastError,
+		ConsecutiveFailures: h.consecutiveFailures,
+		RoundTripMs:         float64(h.rtt) / float64(time.Millisecond),
+	}
+	if !h.lastSeen.IsZero() {
+		v.LastSeen = h.lastSeen.UTC().Format(time.RFC3339)
+	}
+	if !h.lastErrorTime.IsZero() {
+		v.LastErrorTime = h.lastErrorTime.UTC().Format(time.RFC3339)
+	}
+	return v
+}
+
+// MiGetHealth returns the health of every switch
+func MiGetHealth() []DeviceHealth {
+	sm.RLock()
+	defer sm.RUnlock()
+	val := make([]DeviceHealth, len(s.Devices))
+	for i := range s.Devices {
+		val[i] = s.Devices[i].health.view(int32(i), s.Devices[i].displayName())
+	}
+	return val
+}
+
+// MiCheckOnline returns errSwitchOffline for an offline switch when reads of
+// offline switches are configured to fail instead of returning stale data
+func MiCheckOnline(id int32) error {
+	sm.RLock()
+	defer sm.RUnlock()
+	if s.poll.OfflineError && int(id) < len(s.Devices) && s.Devices[id].health.offline {
+		return errSwitchOffline
+	}
+	return nil
+}
+
+// recordExchange updates the health of the switch with the given uniqueid
+func (s *sw) recordExchange(uid string, rtt time.Duration, err error, quiet bool) {
+	sm.Lock()
+	defer sm.Unlock()
+	if i := s.indexOf(uid); i >= 0 {
+		s.Devices[i].recordHealth(rtt, err, s.poll.OfflineAfter, quiet)
+		observeExchange(i, rtt, err)
+	}
+}
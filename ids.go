@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// controllerKey names the single Alpaca Switch device served by this driver
+// in the persisted table of Alpaca UniqueIDs
+const controllerKey = "Switch/1"
+
+// assignAlpacaIDs returns the persisted UniqueID of every Alpaca device,
+// creating the missing ones. An installation upgraded from the time the
+// controller reported its first switch's uniqueid keeps that value so
+// existing client profiles stay valid; a new installation gets a fresh UUID.
+// Either way it is stored and no longer follows the first switch.
+func assignAlpacaIDs(ids map[string]string, devices []Device) (map[string]string, error) {
+	out := make(map[string]string, len(ids)+1)
+	for k, v := range ids {
+		out[k] = v
+	}
+	if out[controllerKey] != "" {
+		return out, nil
+	}
+	if len(devices) > 0 && devices[0].Uniqueid != "" {
+		out[controllerKey] = devices[0].Uniqueid
+		return out, nil
+	}
+	uid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Created UniqueID for the Alpaca switch device", "uniqueid", uid)
+	out[controllerKey] = uid
+	return out, nil
+}
+
+// resolveSwitchIDs fills in the uniqueid of every device configured without
+// one. The id is taken, in order, from a previous run (remembered, keyed by
+// IP), derived from the did in settings.json, derived from the device ID the
+// plug reports in its miIO handshake, or as a last resort generated at
+// random. The returned table remembers every id handed out so it stays the
+// same on later runs even when the plug is offline.
+func resolveSwitchIDs(devices []Device, remembered map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(remembered))
+	for k, v := range remembered {
+		out[k] = v
+	}
+	for i := range devices {
+		d := &devices[i]
+		if d.Uniqueid != "" {
+			continue
+		}
+		if uid, ok := out[d.IP]; ok {
+			d.Uniqueid = uid
+			continue
+		}
+
+		did := d.Did
+		if did == "" {
+			if release, err := acquirePlug(context.Background(), d.IP); err == nil {
+				if id, _, err := discoverDevice(d.IP); err == nil && len(id) == 4 {
+					did = strconv.FormatUint(uint64(binary.BigEndian.Uint32(id)), 10)
+				}
+				release()
+			}
+		}
+		if did != "" {
+			d.Uniqueid = deriveUUID("miio-did:" + did)
+		} else {
+			// Not from the token: the id is public and must survive a new token
+			uid, err := newUUID()
+			if err != nil {
+				return nil, err
+			}
+			slog.Warn("Device has no uniqueid and did not answer; generated a random one", "device", *d)
+			d.Uniqueid = uid
+		}
+		slog.Info("Generated switch uniqueid", "device", *d, "uniqueid", d.Uniqueid)
+		out[d.IP] = d.Uniqueid
+	}
+	return out, nil
+}
+
+// deriveUUID returns a name-based (version 5 style) UUID for name, so the
+// same plug always maps to the same id
+func deriveUUID(name string) string {
+	sum := sha1.Sum([]byte("mi_alpaca/" + name))
+	b := sum[:16]
+	b[6] = b[6]&0x0f | 0x50
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b), nil
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// importedDevice is a device read from another tool's export
+type importedDevice struct {
+	Name  string
+	IP    string
+	Token string
+	Model string
+	Did   string
+}
+
+// Import formats understood by parseImport
+const (
+	importAuto     = "auto"
+	importMiio     = "miio"      // miiocli cloud list
+	importMiioJSON = "miio-json" // miiocli cloud list --json-output
+	importHA       = "ha"        // Home Assistant .storage/core.config_entries
+	importCSV      = "csv"       // name,ip,token[,model,did]
+)
+
+// parseImport reads devices from data in the given format, detecting the
+// format from the file name and contents when it is importAuto
+func parseImport(name string, data []byte, format string) ([]importedDevice, error) {
+	if format == importAuto {
+		format = detectImportFormat(name, data)
+	}
+	switch format {
+	case importMiio:
+		return parseMiioCloud(data)
+	case importMiioJSON:
+		return parseMiioCloudJSON(data)
+	case importHA:
+		return parseHAConfigEntries(data)
+	case importCSV:
+		return parseImportCSV(data)
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+}
+
+func detectImportFormat(name string, data []byte) string {
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		return importCSV
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return importMiio
+	}
+	var probe struct {
+		Data struct {
+			Entries []json.RawMessage `json:"entries"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(trimmed, &probe) == nil && probe.Data.Entries != nil {
+		return importHA
+	}
+	return importMiioJSON
+}
+
+// parseMiioCloud parses the text printed by "miiocli cloud list":
+//
+//	== Desk plug (Device online ) ==
+//		Model: chuangmi.plug.m1
+//		Token: 0123456789abcdef0123456789abcdef
+//		IP: 192.168.1.10 (mac: 04:CF:8C:00:00:00)
+//		DID: 123456789
+func parseMiioCloud(data []byte) ([]importedDevice, error) {
+	var devices []importedDevice
+	var cur *importedDevice
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "==") {
+			name := strings.TrimSpace(strings.Trim(line, "="))
+			if i := strings.LastIndex(name, " ("); i > 0 {
+				name = name[:i]
+			}
+			devices = append(devices, importedDevice{Name: name})
+			cur = &devices[len(devices)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || cur == nil {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "model":
+			cur.Model = value
+		case "token":
+			cur.Token = value
+		case "ip":
+			if f := strings.Fields(value); len(f) > 0 {
+				cur.IP = f[0]
+			}
+		case "did":
+			cur.Did = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("no devices found in miiocli output")
+	}
+	return devices, nil
+}
+
+// parseMiioCloudJSON accepts the JSON cloud listing either as an array of
+// devices or as an object keyed by device id
+func parseMiioCloudJSON(data []byte) ([]importedDevice, error) {
+	type cloudDevice struct {
+		Name    string          `json:"name"`
+		IP      string          `json:"ip"`
+		LocalIP string          `json:"localip"`
+		Token   string          `json:"token"`
+		Model   string          `json:"model"`
+		Did     json.RawMessage `json:"did"`
+	}
+
+	var list []cloudDevice
+	if err := json.Unmarshal(data, &list); err != nil {
+		var byID map[string]cloudDevice
+		if err := json.Unmarshal(data, &byID); err != nil {
+			return nil, fmt.Errorf("not a miiocli JSON device list: %w", err)
+		}
+		// Sorted by did, so every import numbers the devices the same way
+		dids := make([]string, 0, len(byID))
+		for did := range byID {
+			dids = append(dids, did)
+		}
+		slices.SortFunc(dids, compareDids)
+		for _, did := range dids {
+			d := byID[did]
+			if len(d.Did) == 0 {
+				d.Did, _ = json.Marshal(did)
+			}
+			list = append(list, d)
+		}
+	}
+
+	var devices []importedDevice
+	for _, d := range list {
+		ip := d.LocalIP
+		if ip == "" {
+			ip = d.IP
+		}
+		devices = append(devices, importedDevice{
+			Name:  d.Name,
+			IP:    ip,
+			Token: d.Token,
+			Model: d.Model,
+			Did:   strings.Trim(string(d.Did), `"`),
+		})
+	}
+	return devices, nil
+}
+
+// compareDids orders numeric device ids by value and others as strings
+func compareDids(a, b string) int {
+	if len(a) != len(b) && isDigits(a) && isDigits(b) {
+		return cmp.Compare(len(a), len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// parseHAConfigEntries reads the xiaomi_miio entries of Home Assistant's
+// .storage/core.config_entries
+func parseHAConfigEntries(data []byte) ([]importedDevice, error) {
+	var store struct {
+		Data struct {
+			Entries []struct {
+				Domain string `json:"domain"`
+				Title  string `json:"title"`
+				Data   struct {
+					Host  string `json:"host"`
+					Token string `json:"token"`
+					Model string `json:"model"`
+				} `json:"data"`
+			} `json:"entries"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("not a Home Assistant config entries file: %w", err)
+	}
+
+	var devices []importedDevice
+	for _, e := range store.Data.Entries {
+		if e.Domain != "xiaomi_miio" || e.Data.Host == "" {
+			continue
+		}
+		devices = append(devices, importedDevice{
+			Name:  e.Title,
+			IP:    e.Data.Host,
+			Token: e.Data.Token,
+			Model: e.Data.Model,
+		})
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("no xiaomi_miio devices in Home Assistant config entries")
+	}
+	return devices, nil
+}
+
+// parseImportCSV reads a CSV file whose header names the columns; name, ip
+// and token are required, model and did are optional
+func parseImportCSV(data []byte) ([]importedDevice, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"name", "ip", "token"} {
+		if _, ok := col[required]; !ok {
+			return nil, fmt.Errorf("CSV header has no %q column", required)
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	var devices []importedDevice
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, importedDevice{
+			Name:  field(rec, "name"),
+			IP:    field(rec, "ip"),
+			Token: field(rec, "token"),
+			Model: field(rec, "model"),
+			Did:   field(rec, "did"),
+		})
+	}
+	return devices, nil
+}
+
+// isSwitchModel reports whether a miIO model is a plug or switch that this
+// driver can control. Devices without a model, as from CSV, are assumed to be.
+func isSwitchModel(model string) bool {
+	if model == "" {
+		return true
+	}
+	m := strings.ToLower(model)
+	return strings.Contains(m, "plug") || strings.Contains(m, "outlet") || strings.Contains(m, "switch")
+}
+
+// buildConfig turns imported devices into a configuration with sequential
+// ids and numbers and on/off switch defaults. Devices with a did get the
+// same uniqueid resolveSwitchIDs would derive, so a re-import keeps their
+// saved state; others get a fresh one.
+func buildConfig(imported []importedDevice) (config, error) {
+	var cfg config
+	for i, d := range imported {
+		uid := deriveUUID("miio-did:" + d.Did)
+		if d.Did == "" {
+			var err error
+			if uid, err = newUUID(); err != nil {
+				return config{}, err
+			}
+		}
+		cfg.Devices = append(cfg.Devices, Device{
+			IP:         d.IP,
+			Token:      deviceToken(strings.ToLower(d.Token)),
+			Name:       "Switch " + strconv.Itoa(i+1),
+			Devicetype: "Switch",
+			Number:     uint32(i + 1),
+			Uniqueid:   uid,
+			Id:         uint32(i),
+			Customname: d.Name,
+			Model:      d.Model,
+			Did:        d.Did,
+			Min:        0,
+			Max:        1,
+			Step:       1,
+			Canwrite:   true,
+		})
+	}
+	return cfg, nil
+}
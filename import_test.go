@@ -0,0 +1,144 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+const importToken = "0123456789abcdef0123456789abcdef"
+
+func TestParseImport(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		format  string
+		data    string
+		want    []importedDevice
+		wantErr bool
+	}{
+		{
+			name: "miiocli text",
+			file: "devices.txt",
+			data: `Logging in...
+== Desk plug (Device online ) ==
+	Model: chuangmi.plug.m1
+	Token: ` + importToken + `
+	IP: 192.168.1.10 (mac: 04:CF:8C:00:00:00)
+	DID: 123456789
+== Lamp (Device offline ) ==
+	Model: yeelink.light.color1
+	Token: ` + importToken + `
+	IP: 192.168.1.11 (mac: 04:CF:8C:00:00:01)
+	DID: 987
+`,
+			format: importAuto,
+			want: []importedDevice{
+				{Name: "Desk plug", IP: "192.168.1.10", Token: importToken, Model: "chuangmi.plug.m1", Did: "123456789"},
+				{Name: "Lamp", IP: "192.168.1.11", Token: importToken, Model: "yeelink.light.color1", Did: "987"},
+			},
+		},
+		{
+			name:    "miiocli text without devices",
+			file:    "devices.txt",
+			format:  importMiio,
+			data:    "Logging in...\n",
+			wantErr: true,
+		},
+		{
+			name:   "miiocli JSON array",
+			file:   "devices.json",
+			format: importAuto,
+			data:   `[{"name": "Desk plug", "localip": "192.168.1.10", "ip": "1.2.3.4", "token": "` + importToken + `", "model": "chuangmi.plug.m1", "did": "123"}]`,
+			want: []importedDevice{
+				{Name: "Desk plug", IP: "192.168.1.10", Token: importToken, Model: "chuangmi.plug.m1", Did: "123"},
+			},
+		},
+		{
+			name:   "miiocli JSON keyed by did in numeric order",
+			file:   "devices.json",
+			format: importAuto,
+			data: `{"1000": {"name": "B", "ip": "192.168.1.11", "token": "` + importToken + `"},
+				"999": {"name": "A", "ip": "192.168.1.10", "token": "` + importToken + `", "did": 999}}`,
+			want: []importedDevice{
+				{Name: "A", IP: "192.168.1.10", Token: importToken, Did: "999"},
+				{Name: "B", IP: "192.168.1.11", Token: importToken, Did: "1000"},
+			},
+		},
+		{
+			name:    "miiocli JSON of the wrong shape",
+			format:  importMiioJSON,
+			data:    `"plug"`,
+			wantErr: true,
+		},
+		{
+			name:   "Home Assistant config entries",
+			file:   "core.config_entries",
+			format: importAuto,
+			data: `{"data": {"entries": [
+				{"domain": "xiaomi_miio", "title": "Desk plug", "data": {"host": "192.168.1.10", "token": "` + importToken + `", "model": "chuangmi.plug.m1"}},
+				{"domain": "hue", "title": "Bridge", "data": {"host": "192.168.1.2"}},
+				{"domain": "xiaomi_miio", "title": "Gateway", "data": {}}]}}`,
+			want: []importedDevice{
+				{Name: "Desk plug", IP: "192.168.1.10", Token: importToken, Model: "chuangmi.plug.m1"},
+			},
+		},
+		{
+			name:    "Home Assistant without miio entries",
+			format:  importHA,
+			data:    `{"data": {"entries": [{"domain": "hue", "data": {"host": "192.168.1.2"}}]}}`,
+			wantErr: true,
+		},
+		{
+			name:   "CSV with columns in any order",
+			file:   "plugs.CSV",
+			format: importAuto,
+			data:   "Token, IP, Name, did\n" + importToken + ", 192.168.1.10, Desk plug, 42\n" + importToken + ",192.168.1.11,Heater\n",
+			want: []importedDevice{
+				{Name: "Desk plug", IP: "192.168.1.10", Token: importToken, Did: "42"},
+				{Name: "Heater", IP: "192.168.1.11", Token: importToken},
+			},
+		},
+		{
+			name:    "CSV without a token column",
+			format:  importCSV,
+			data:    "name,ip\nDesk plug,192.168.1.10\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			data:    "<devices/>",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImport(tt.file, []byte(tt.data), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSwitchModel(t *testing.T) {
+	tests := []struct {
+		model string
+		want  bool
+	}{
+		{"", true},
+		{"chuangmi.plug.m1", true},
+		{"cuco.plug.cp1", true},
+		{"lumi.ctrl_neutral1.switch", true},
+		{"yeelink.light.color1", false},
+		{"zhimi.airpurifier.m1", false},
+	}
+	for _, tt := range tests {
+		if got := isSwitchModel(tt.model); got != tt.want {
+			t.Errorf("isSwitchModel(%q) = %v, want %v", tt.model, got, tt.want)
+		}
+	}
+}
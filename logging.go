@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logConfig selects the log level and output format
+type logConfig struct {
+	Level  string `json:"level,omitempty"`  // debug, info, warn or error; default info
+	Format string `json:"format,omitempty"` // text or json; default text
+}
+
+// Environment variables that override the log section of settings.json, so
+// problems while loading the settings themselves can be debugged
+const (
+	logLevelEnv  = "MI_ALPACA_LOG_LEVEL"
+	logFormatEnv = "MI_ALPACA_LOG_FORMAT"
+)
+
+var (
+	logLevel  = new(slog.LevelVar)
+	logFormat string
+)
+
+// configureLogging installs the default logger described by c, with the
+// environment taking precedence. The level can change at any time; the
+// format only replaces the handler when it differs.
+func configureLogging(c logConfig) error {
+	if v := os.Getenv(logLevelEnv); v != "" {
+		c.Level = v
+	}
+	if v := os.Getenv(logFormatEnv); v != "" {
+		c.Format = v
+	}
+
+	level, err := parseLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(c.Format)
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("log format must be text or json, not %q", c.Format)
+	}
+
+	logLevel.Set(level)
+	if format != logFormat {
+		slog.SetDefault(slog.New(newLogHandler(os.Stderr, format)))
+		logFormat = format
+	}
+	return nil
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("log level must be debug, info, warn or error, not %q", s)
+	}
+	return level, nil
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying l, used to tag every record written
+// while handling a request with that request's ids
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger stored in ctx, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// correlate assigns the ServerTransactionID of each request and stores a
+// logger tagged with the Alpaca transaction ids, and the client as the
+// source of any switch change, in the request context
+func (srv *ApiServer) correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		stid := srv.nextTransactionID()
+		l := slog.Default()
+		src := auditSource{Kind: sourceAlpaca, Remote: r.RemoteAddr, ServerTransactionID: stid}
+		if isAlpacaRequest(r) {
+			cid := getClientId(r)
+			l = l.With("clientid", cid, "clienttransactionid", getClientTransactionId(r))
+			if cid >= 0 {
+				src.ClientID = &cid
+			}
+		}
+		l = l.With("servertransactionid", stid)
+		ctx := context.WithValue(withLogger(r.Context(), l), transactionIDKey{}, stid)
+		ctx = withAuditSource(ctx, src)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		l.Debug("Request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+			"status", sw.status, "duration", time.Since(start))
+	})
+}
+
+// statusWriter remembers the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// LogValue describes the device in log records. The token is left out.
+func (d Device) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", int(d.Id)),
+		slog.String("name", d.displayName()),
+		slog.String("ip", d.IP),
+		slog.String("model", d.Model),
+	)
+}
+
+// LogValue keeps tokens out of structured log records
+func (t deviceToken) LogValue() slog.Value {
+	return slog.StringValue(t.String())
+}
+
+// logConfigErrors writes one record per problem so each keeps its file and
+// line, instead of a single multi-line message
+func logConfigErrors(msg string, err error) {
+	var errs configErrors
+	if !errors.As(err, &errs) {
+		slog.Error(msg, "error", err)
+		return
+	}
+	for _, e := range errs {
+		slog.Error(msg, "error", e.Error())
+	}
+}
@@ -1,26 +1,106 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
 const (
 	apiPort              = 8080
 	DiscoveryPort        = 32227
 	DefaultAlpacaApiPort = 11111
 	ListenIP             = "127.0.0.1"
 	Location             = "Earth"
+	shutdownTimeout      = 10 * time.Second
 )
 
 func main() {
+	// Environment settings apply until settings.json has been read
+	if err := configureLogging(logConfig{}); err != nil {
+		slog.Error("Invalid logging environment", "error", err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Load initial switch values and query device states
 	MiSetInit()
 
 	// Start discovery server for ASCOM Alpaca device discovery
 	discovery := NewDiscoveryServer(DiscoveryPort, apiPort)
 	go discovery.Start()
-	defer discovery.Close()
+	go discovery.StartIPv6()
 
 	// Start API server for ASCOM Alpaca device control
 	api := NewApiServer(apiPort)
-	go api.Start()
+	go func() {
+		if err := api.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Keep the cached switch states in step with the hardware
+	go MiStartPoller(ctx)
+
+	// Publish switch states to an MQTT broker when one is configured
+	mqttDone := make(chan struct{})
+	go func() {
+		MiStartMQTT(ctx)
+		close(mqttDone)
+	}()
+
+	// Reload the device configuration on SIGHUP or when settings.json changes
+	go watchSettings(ctx, reloadCheckInterval)
+	go reloadOnSIGHUP(ctx)
+
+	// Block until SIGINT or SIGTERM
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	discovery.Close()
+	// Power cycles still waiting would hold up the API shutdown
+	MiEndCycles()
+	if err := api.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("API server shutdown", "error", err)
+	}
+	if err := MiShutdown(shutdownCtx); err != nil {
+		slog.Warn("Device shutdown", "error", err)
+	}
+	select {
+	case <-mqttDone:
+	case <-shutdownCtx.Done():
+	}
+	slog.Info("Shutdown complete")
+}
 
-	// Block forever
-	select {}
+// reloadOnSIGHUP reloads the device configuration each time SIGHUP arrives
+func reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := MiReloadConfig(); err != nil {
+				logConfigErrors("Not reloading settings, keeping the running configuration", err)
+			}
+		}
+	}
 }
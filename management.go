@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -15,6 +19,8 @@ func (srv *ApiServer) configureManagementAPI(router *httprouter.Router) {
 	router.GET("/management/apiversions", srv.handleApiVersions)
 	router.GET("/management/v1/description", srv.handleDescription)
 	router.GET("/management/v1/configureddevices", srv.handleConfiguredDevices)
+	router.GET("/management/v1/devicehealth", srv.handleDeviceHealth)
+	router.GET("/management/v1/audit", srv.handleAudit)
 }
 
 // handleRoot returns the root web page
@@ -56,3 +62,70 @@ func (srv *ApiServer) handleConfiguredDevices(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
+
+// handleDeviceHealth returns the online state, last contact and last error of every switch
+func (srv *ApiServer) handleDeviceHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := deviceHealthResponse{Value: MiGetHealth()}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAudit returns the audit log, optionally limited to a time range
+// (since, until as RFC 3339) and one switch (switch id or uniqueid)
+func (srv *ApiServer) handleAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q, err := getAuditQueryFromRequest(r)
+	if err != nil {
+		resp := stringResponse{Value: err.Error()}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	entries, err := readAuditLog(q)
+	if err != nil {
+		resp := stringResponse{Value: err.Error()}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	resp := auditResponse{Value: entries}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func getAuditQueryFromRequest(r *http.Request) (auditQuery, error) {
+	var q auditQuery
+	params := r.URL.Query()
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time such as 2024-01-02T02:13:00Z", name)
+			}
+			*t = parsed
+		}
+	}
+	q.UniqueID = params.Get("uniqueid")
+	if v := params.Get("switch"); v != "" {
+		// The history of the plug that has this id now
+		id, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || id < 0 || id >= int64(MiGetMaxSwitch()) {
+			return q, errors.New("switch must be a switch id")
+		}
+		uid := MiGetUniqueID(int32(id))
+		if q.UniqueID != "" && !strings.EqualFold(q.UniqueID, uid) {
+			return q, errors.New("switch and uniqueid name different switches")
+		}
+		q.UniqueID = uid
+	}
+	return q, nil
+}
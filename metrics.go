@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Metrics are kept in memory and written in the Prometheus text exposition
+// format by /metrics, so no client library or push gateway is needed.
+
+// counterVec is a counter partitioned by a fixed list of labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // keyed by the rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := renderLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by a fixed list of labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram // keyed by label values joined with \xff
+}
+
+type histogram struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs, ok := h.series[key]
+	if !ok {
+		hs = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = hs
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hs.counts[i]++
+			break
+		}
+	}
+	hs.sum += v
+	hs.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hs := h.series[k]
+		labels := append(append([]string{}, h.labels...), "le")
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hs.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(labels, append(append([]string{}, hs.values...), formatFloat(b))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(labels, append(append([]string{}, hs.values...), "+Inf")), hs.count)
+		base := renderLabels(h.labels, hs.values)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, base, formatFloat(hs.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, base, hs.count)
+	}
+}
+
+// renderLabels formats a label set as {a="x",b="y"}
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", n, escapeLabel(v))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	metricDeviceRTT = newHistogramVec("mi_alpaca_device_rtt_seconds",
+		"Round-trip time of successful exchanges with a plug.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}, "switch")
+	metricMiioErrors = newCounterVec("mi_alpaca_miio_errors_total",
+		"Failed exchanges with a plug by error type.", "switch", "type")
+	metricAlpacaRequests = newCounterVec("mi_alpaca_alpaca_requests_total",
+		"HTTP requests by endpoint, status, Alpaca ErrorNumber and ClientID.", "endpoint", "status", "error_number", "client_id")
+	metricDiscoveryPackets = newCounterVec("mi_alpaca_discovery_packets_total",
+		"Discovery packets received by outcome.", "result")
+)
+
+// observeExchange records the outcome of one exchange with switch id
+func observeExchange(id int32, rtt time.Duration, err error) {
+	sw := strconv.Itoa(int(id))
+	if err != nil {
+		metricMiioErrors.inc(sw, miioErrorType(err))
+		return
+	}
+	metricDeviceRTT.observe(rtt.Seconds(), sw)
+}
+
+func (srv *ApiServer) configureMetricsAPI(router *httprouter.Router) {
+	router.GET("/metrics", srv.handleMetrics)
+}
+
+// handleMetrics writes all metrics in the Prometheus text format
+func (srv *ApiServer) handleMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var b bytes.Buffer
+
+	sm.RLock()
+	b.WriteString("# HELP mi_alpaca_switch_state Cached switch value (0 = off, 1 = on).\n# TYPE mi_alpaca_switch_state gauge\n")
+	for i, d := range s.Devices {
+		fmt.Fprintf(&b, "mi_alpaca_switch_state%s %d\n", switchLabels(i, &d), d.Value)
+	}
+	b.WriteString("# HELP mi_alpaca_switch_online Whether the switch is answering (1) or offline (0).\n# TYPE mi_alpaca_switch_online gauge\n")
+	for i, d := range s.Devices {
+		online := 1
+		if d.health.offline {
+			online = 0
+		}
+		fmt.Fprintf(&b, "mi_alpaca_switch_online%s %d\n", switchLabels(i, &d), online)
+	}
+	connected := 0
+	if s.Connected {
+		connected = 1
+	}
+	fmt.Fprintf(&b, "# HELP mi_alpaca_connected Alpaca connected flag.\n# TYPE mi_alpaca_connected gauge\nmi_alpaca_connected %d\n", connected)
+	sm.RUnlock()
+
+	metricDeviceRTT.write(&b)
+	metricMiioErrors.write(&b)
+	metricAlpacaRequests.write(&b)
+	metricDiscoveryPackets.write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
+
+func switchLabels(i int, d *Device) string {
+	return renderLabels([]string{"switch", "name", "uniqueid"}, []string{strconv.Itoa(i), d.displayName(), d.Uniqueid})
+}
+
+// instrument counts every request handled by next, naming endpoints after
+// the routes of router
+func (srv *ApiServer) instrument(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		endpoint := "other"
+		if h, ps, _ := router.Lookup(r.Method, r.URL.Path); h != nil {
+			endpoint = routePattern(r.URL.Path, ps)
+		}
+		errorNumber := ""
+		var body struct {
+			ErrorNumber *int32 `json:"ErrorNumber"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &body) == nil && body.ErrorNumber != nil {
+			errorNumber = strconv.Itoa(int(*body.ErrorNumber))
+		}
+		clientID := ""
+		if isAlpacaRequest(r) {
+			if cid := getClientId(r); cid >= 0 {
+				clientID = clientIDLabels.label(strconv.Itoa(cid))
+			}
+		}
+		metricAlpacaRequests.inc(endpoint, strconv.Itoa(rec.status), errorNumber, clientID)
+	})
+}
+
+// metricsMaxClientIDs bounds the client_id label: clients pick their own
+// ClientID, so one that makes up a new id per request would otherwise add a
+// series each time
+const metricsMaxClientIDs = 32
+
+// labelSet hands out the first values it sees as labels and "other" for the
+// rest
+type labelSet struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]bool
+}
+
+var clientIDLabels = &labelSet{max: metricsMaxClientIDs, seen: make(map[string]bool)}
+
+func (l *labelSet) label(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.seen[v] {
+		if len(l.seen) >= l.max {
+			return "other"
+		}
+		l.seen[v] = true
+	}
+	return v
+}
+
+// routePattern turns a path matched by the router back into its route, such
+// as /v1/switches/:id, so every switch and every rejected guess of an id
+// shares one label. Parameters are put back from the right, where the
+// routes have them.
+func routePattern(path string, ps httprouter.Params) string {
+	segs := strings.Split(path, "/")
+	for i, k := len(segs)-1, len(ps)-1; i >= 0 && k >= 0; i-- {
+		if segs[i] == ps[k].Value {
+			segs[i] = ":" + ps[k].Key
+			k--
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// responseRecorder keeps the status and the start of the body of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// maxRecordedBody is enough for the ErrorNumber of any Alpaca response
+const maxRecordedBody = 4096
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of event streams
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if room := maxRecordedBody - rec.body.Len(); room > 0 {
+		rec.body.Write(p[:min(room, len(p))])
+	}
+	return rec.ResponseWriter.Write(p)
+}
@@ -1,41 +1,126 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"slices"
 	"sync"
+	"time"
 )
 
-const NumOnOffSwitch = 6 // Number of on/off switches
-const NumVarSwitch = 0   // Number of variable switches
-const NumSwitches = 6    // Number of all switches in total
-
 type Device struct {
-	IP         string `json:"ip"`
-	Token      string `json:"token"`
-	Name       string `json:"name"`
-	Devicetype string `json:"devicetype"`
-	Number     uint32 `json:"number"`
-	Uniqueid   string `json:"uniqueid"`
-	Id         uint32 `json:"id"`
-	Customname string `json:"customname"`
-	Min        int64  `json:"min"`
-	Max        int64  `json:"max"`
-	Step       int64  `json:"step"`
-	Canwrite   bool   `json:"canwrite"`
-	Value      int64  `json:"value"`
+	IP         string      `json:"ip"`
+	Token      deviceToken `json:"token"`
+	Name       string      `json:"name"`
+	Devicetype string      `json:"devicetype"`
+	Number     uint32      `json:"number"`
+	Uniqueid   string      `json:"uniqueid"`
+	Id         uint32      `json:"id"`
+	Customname string      `json:"customname"`
+	Model      string      `json:"model,omitempty"` // miIO model, e.g. chuangmi.plug.m1
+	Did        string      `json:"did,omitempty"`   // miIO device id
+	Min        int64       `json:"min"`
+	Max        int64       `json:"max"`
+	Step       int64       `json:"step"`
+	Canwrite   bool        `json:"canwrite"`
+	// Value is runtime state kept in state.json; settings.json only supplies
+	// it when no state file exists yet
+	Value int64 `json:"value,omitempty"`
+
+	stateName string // name set through SetSwitchName, persisted in state.json
+	gen       uint64 // bumped on every Alpaca set, lets a slower poll detect it is stale
+	health    deviceHealth
+}
+
+// displayName returns the custom name of the device, or its default name
+func (d *Device) displayName() string {
+	if d.Customname != "" {
+		return d.Customname
+	}
+	return d.Name
 }
 
 type sw struct {
 	Connected bool     `json:"connected"`
 	Devices   []Device `json:"devices"`
+
+	poll      pollConfig
+	mqtt      mqttConfig
+	auth      authConfig
+	tls       tlsConfig // read at startup only
+	access    accessRules
+	alpacaIDs map[string]string // persisted UniqueID per Alpaca device
+	switchIDs map[string]string // uniqueids handed out to switches configured without one, by IP
 }
 
 var s = &sw{}
 var sm sync.RWMutex
 
+// In-flight device commands, tracked so shutdown can wait for them
+var (
+	opsMu    sync.Mutex
+	ops      sync.WaitGroup
+	stopping bool
+)
+
+// endCycles is closed when shutdown starts, so running power cycles turn
+// their plugs back on without waiting out the delay
+var (
+	endCycles     = make(chan struct{})
+	endCyclesOnce sync.Once
+)
+
+// MiEndCycles turns plugs that are being power-cycled back on now
+func MiEndCycles() {
+	endCyclesOnce.Do(func() { close(endCycles) })
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// beginDeviceOp registers a device command; it fails once shutdown has started
+func beginDeviceOp() error {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+	if stopping {
+		return errShuttingDown
+	}
+	ops.Add(1)
+	return nil
+}
+
+func endDeviceOp() {
+	ops.Done()
+}
+
+// MiShutdown refuses new device commands, waits for running ones until ctx
+// expires and then saves the final state
+func MiShutdown(ctx context.Context) error {
+	opsMu.Lock()
+	stopping = true
+	opsMu.Unlock()
+	MiEndCycles()
+
+	done := make(chan struct{})
+	go func() {
+		ops.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("device commands still running: %w", ctx.Err())
+	}
+	if serr := s.miSaveState(); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
 func MiSetInit() {
 	s.misetinit()
 	// Query actual state from all devices after loading settings
@@ -43,104 +128,237 @@ func MiSetInit() {
 }
 
 func (s *sw) misetinit() {
-	if !s.miLoadSettings() {
-		log.Println("No settings file found, exiting")
+	if err := s.miLoadSettings(); err != nil {
+		logConfigErrors("Cannot load settings, exiting", err)
 		os.Exit(1)
 	}
 }
 
 // queryAllDeviceStates queries the actual power state from all Xiaomi devices
 func (s *sw) queryAllDeviceStates() {
-	log.Println("Querying actual state from all devices...")
-	for i := int32(0); i < int32(len(s.Devices)); i++ {
-		state, err := miQueryPower(i)
-		if err != nil {
-			log.Printf("Warning: Failed to query device %d (%s): %v - keeping cached value", i+1, s.Devices[i].Name, err)
-			continue
+	if err := beginDeviceOp(); err != nil {
+		return
+	}
+	defer endDeviceOp()
+
+	slog.Info("Querying actual state from all devices")
+	s.queryDevices(nil, true)
+	if err := s.miSaveState(); err != nil {
+		slog.Warn("Failed to save state", "error", err)
+	}
+	slog.Info("Device state query complete")
+}
+
+// Limits for querying many devices at once
+const (
+	maxParallelQueries = 4                // devices queried at the same time
+	queryDeadline      = 10 * time.Second // overall time allowed for one round
+)
+
+// queryResult is the outcome of querying one device
+type queryResult struct {
+	uid   string
+	gen   uint64
+	state bool
+	rtt   time.Duration
+	err   error
+}
+
+// queryDevices refreshes the cached values of the devices at the given
+// indexes, or of all devices when ids is nil. Devices are queried in
+// parallel; results are merged as they arrive and any still outstanding at
+// queryDeadline are dropped. It reports whether a cached value changed.
+func (s *sw) queryDevices(ids []int32, verbose bool) bool {
+	sm.RLock()
+	var devices []Device
+	if ids == nil {
+		devices = append(devices, s.Devices...)
+	} else {
+		for _, i := range ids {
+			if int(i) < len(s.Devices) {
+				devices = append(devices, s.Devices[i])
+			}
 		}
+	}
+	sm.RUnlock()
+	if len(devices) == 0 {
+		return false
+	}
 
-		sm.Lock()
-		if state {
-			s.Devices[i].Value = 1
-		} else {
-			s.Devices[i].Value = 0
+	// Workers still waiting for a busy plug give up at the deadline too
+	ctx, cancel := context.WithTimeout(context.Background(), queryDeadline)
+	defer cancel()
+
+	jobs := make(chan Device)
+	results := make(chan queryResult, len(devices)) // buffered so late workers never block
+	for w := 0; w < min(maxParallelQueries, len(devices)); w++ {
+		go func() {
+			for d := range jobs {
+				release, err := acquirePlug(ctx, d.IP)
+				if err != nil {
+					results <- queryResult{uid: d.Uniqueid, gen: d.gen, err: err}
+					continue
+				}
+				start := time.Now()
+				state, err := queryPower(d)
+				rtt := time.Since(start)
+				release()
+				results <- queryResult{uid: d.Uniqueid, gen: d.gen, state: state, rtt: rtt, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, d := range devices {
+			jobs <- d
 		}
-		sm.Unlock()
-		log.Printf("Device %d (%s): %v", i+1, s.Devices[i].Name, state)
+		close(jobs)
+	}()
+
+	changed := false
+	for n := 0; n < len(devices); n++ {
+		select {
+		case r := <-results:
+			if s.applyQueryResult(r, verbose) {
+				changed = true
+			}
+		case <-ctx.Done():
+			slog.Warn("Devices did not answer in time, keeping cached values", "devices", len(devices)-n, "deadline", queryDeadline)
+			return changed
+		}
+	}
+	return changed
+}
+
+// applyQueryResult merges one query result into the cache and reports
+// whether the cached value changed. A value that differs from the cache was
+// changed outside Alpaca, e.g. with the plug's button, and is recorded in the
+// audit log. When verbose is set every result is logged, otherwise only
+// changes.
+func (s *sw) applyQueryResult(r queryResult, verbose bool) bool {
+	changed, entry := s.mergeQueryResult(r, verbose)
+	if entry != nil {
+		auditRecord(*entry)
 	}
-	s.miSaveSettings()
-	log.Println("Device state query complete")
+	return changed
 }
 
-func (s *sw) miSaveSettings() {
+func (s *sw) mergeQueryResult(r queryResult, verbose bool) (bool, *auditEntry) {
 	sm.Lock()
 	defer sm.Unlock()
+	// The device list may have been reloaded while the plug was queried
+	i := s.indexOf(r.uid)
+	if i < 0 {
+		return false, nil
+	}
+	d := &s.Devices[i]
 
-	data, err := json.MarshalIndent(&s, "", "    ")
-	if err != nil {
-		panic(err)
+	d.recordHealth(r.rtt, r.err, s.poll.OfflineAfter, !verbose)
+	observeExchange(i, r.rtt, r.err)
+	if r.err != nil {
+		return false, nil
 	}
-	err = os.WriteFile("settings.json", data, 0644)
-	if err != nil {
-		panic(err)
+	// A set through Alpaca finished while we were waiting; it is newer
+	if d.gen != r.gen {
+		return false, nil
+	}
+
+	var value int64
+	if r.state {
+		value = 1
 	}
+	changed := d.Value != value
+	var entry *auditEntry
+	if changed {
+		source := sourceRefresh
+		if !verbose {
+			source = sourcePoller
+			slog.Info("Device changed outside Alpaca", "device", *d, "from", d.Value != 0, "to", r.state)
+		}
+		e := newAuditEntry(i, d, d.Value, value, auditSource{Kind: source})
+		e.Result = auditObserved
+		entry = &e
+	}
+	d.Value = value
+	if changed {
+		events.publish(newSwitchEvent(d))
+	}
+	if verbose {
+		slog.Info("Device state", "device", *d, "on", r.state)
+	}
+	return changed, entry
 }
 
-func (s *sw) miLoadSettings() bool {
-	sm.Lock()
-	defer sm.Unlock()
-	data, err := os.ReadFile("settings.json")
-	if err != nil {
-		return false
+// indexOf returns the index of the device with the given uniqueid or -1.
+// The caller must hold sm.
+func (s *sw) indexOf(uid string) int32 {
+	for i := range s.Devices {
+		if s.Devices[i].Uniqueid == uid {
+			return int32(i)
+		}
 	}
-	return json.Unmarshal(data, &s) == nil
+	return -1
 }
 
 func MiGetInit() []DeviceConfiguration {
-	sm.Lock()
-	defer sm.Unlock()
+	sm.RLock()
+	defer sm.RUnlock()
 	var val []DeviceConfiguration
-	// Return only a single Switch device that contains all 6 switches
-	// Use the first device's information as the base
+	// Return only a single Switch device that contains all switches
 	if len(s.Devices) > 0 {
 		val = append(val, DeviceConfiguration{
 			DeviceName:   "Mi Switch Controller",
 			DeviceType:   "Switch",
 			DeviceNumber: 1,
-			UniqueID:     s.Devices[0].Uniqueid,
+			UniqueID:     s.alpacaIDs[controllerKey],
 		})
 	}
 	return val
 }
 
+// MiGetMaxSwitch returns the number of configured switches
+func MiGetMaxSwitch() int {
+	sm.RLock()
+	defer sm.RUnlock()
+	return len(s.Devices)
+}
+
 func MiSetName(id int32, CustomName string) error {
-	if id < 0 || id >= NumSwitches {
+	if id < 0 || int(id) >= MiGetMaxSwitch() {
 		return errors.New("invalid device number")
 	}
-	s.setname(id, CustomName)
-	return nil
+	return s.setname(id, CustomName)
 }
 
-func (s *sw) setname(id int32, CustomName string) {
+func (s *sw) setname(id int32, CustomName string) error {
 	sm.Lock()
+	if int(id) >= len(s.Devices) {
+		sm.Unlock()
+		return errors.New("invalid device number")
+	}
 	s.Devices[id].Customname = CustomName
+	s.Devices[id].stateName = CustomName
+	events.publish(newSwitchEvent(&s.Devices[id]))
 	sm.Unlock()
-	s.miSaveSettings()
+	return s.miSaveState()
 }
 
-func MiSetConnect(c bool) {
-	s.setconnect(c)
+func MiSetConnect(c bool) error {
+	if err := s.setconnect(c); err != nil {
+		return err
+	}
 	// When connecting, refresh all device states from hardware
 	if c {
 		s.queryAllDeviceStates()
 	}
+	return nil
 }
 
-func (s *sw) setconnect(c bool) {
+func (s *sw) setconnect(c bool) error {
 	sm.Lock()
 	s.Connected = c
+	events.publish(newConnectedEvent(c))
 	sm.Unlock()
-	s.miSaveSettings()
+	return s.miSaveState()
 }
 
 func MiGetConnected() bool {
@@ -148,104 +366,199 @@ func MiGetConnected() bool {
 }
 
 func (s *sw) getconnected() bool {
-	sm.Lock()
-	defer sm.Unlock()
+	sm.RLock()
+	defer sm.RUnlock()
 	return s.Connected
 }
 
 func MiGetName(id int32) string {
-	sm.Lock()
-	defer sm.Unlock()
-	if s.Devices[id].Customname != "" {
-		return s.Devices[id].Customname
-	}
-	return s.Devices[id].Name
+	d, _ := s.deviceAt(id)
+	return d.displayName()
 }
 
 func MiGetType(id int32) string {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Devicetype
+	d, _ := s.deviceAt(id)
+	return d.Devicetype
 }
 
 func MiGetNumber(id uint32) uint32 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Number
+	d, _ := s.deviceAt(int32(id))
+	return d.Number
 }
 
 func MiGetUniqueID(id int32) string {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Uniqueid
+	d, _ := s.deviceAt(id)
+	return d.Uniqueid
 }
 
 func MiGetOnOff(id int32) (bool, error) {
-	sm.Lock()
-	defer sm.Unlock()
-	if s.Devices[id].Max > 1 {
+	d, ok := s.deviceAt(id)
+	if !ok {
+		return false, errors.New("invalid switch number")
+	}
+	if d.Max > 1 {
 		return false, errors.New("device is not just an on/off switch")
 	}
-	return s.Devices[id].Value != 0, nil
+	return d.Value != 0, nil
 }
 
 func MiGetValue(id int32) int64 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Value
+	d, _ := s.deviceAt(id)
+	return d.Value
 }
 
 func MiGetMax(id int32) int64 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Max
+	d, _ := s.deviceAt(id)
+	return d.Max
 }
 
 func MiGetMin(id int32) int64 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Min
+	d, _ := s.deviceAt(id)
+	return d.Min
 }
 
 func MiGetStep(id int32) int64 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Step
+	d, _ := s.deviceAt(id)
+	return d.Step
 }
 
 func MiGetCanWrite(id int32) bool {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices[id].Canwrite
+	d, _ := s.deviceAt(id)
+	return d.Canwrite
 }
 
-// MiSetOnOff sends the command to turn the switches on or off (id is from 1 to 6)
-func MiSetOnOff(id int32, state bool) error {
-	if id < 1 || id > NumOnOffSwitch {
-		return errors.New("invalid switch number")
+// MiSetOnOff sends the command to turn the switches on or off (id counts from 0)
+// The command waits for other commands to the same plug; the cached value is
+// updated before the plug is released, so it follows the order of commands.
+func MiSetOnOff(ctx context.Context, id int32, state bool) error {
+	_, err := s.switchPlug(ctx, id, func(bool) bool { return state })
+	return err
+}
+
+// MiToggle turns switch id over and returns its new state. The current state
+// is read once the plug is free, so concurrent toggles do not cancel out.
+func MiToggle(ctx context.Context, id int32) (bool, error) {
+	return s.switchPlug(ctx, id, func(on bool) bool { return !on })
+}
+
+// Limits for MiCycle
+const (
+	defaultCycleDelay = 5 * time.Second
+	maxCycleDelay     = 5 * time.Minute
+)
+
+// MiCycle power-cycles switch id: it is turned off, and on again after delay.
+// The whole cycle is one device command, so shutdown waits for it. Once the
+// plug is off it is always turned on again: early when shutdown starts, and
+// also when the client goes away.
+func MiCycle(ctx context.Context, id int32, delay time.Duration) error {
+	if err := beginDeviceOp(); err != nil {
+		return err
 	}
+	defer endDeviceOp()
 
-	if err := miOnOff(id, state); err != nil {
+	if _, err := s.sendSwitch(ctx, id, func(bool) bool { return false }); err != nil {
 		return err
 	}
-	return s.setonoff(id, state)
+	select {
+	case <-time.After(delay):
+	case <-endCycles:
+	}
+	_, err := s.sendSwitch(context.WithoutCancel(ctx), id, func(bool) bool { return true })
+	return err
+}
+
+// switchPlug sets switch id to the state next returns for its cached state
+// and returns the new state
+func (s *sw) switchPlug(ctx context.Context, id int32, next func(on bool) bool) (bool, error) {
+	if err := beginDeviceOp(); err != nil {
+		return false, err
+	}
+	defer endDeviceOp()
+	return s.sendSwitch(ctx, id, next)
 }
 
-func (s *sw) setonoff(id int32, state bool) error {
+// sendSwitch is switchPlug for a caller that has begun a device command
+func (s *sw) sendSwitch(ctx context.Context, id int32, next func(on bool) bool) (bool, error) {
+	d, ok := s.deviceAt(id)
+	if !ok {
+		return false, errors.New("invalid switch number")
+	}
+
+	release, err := acquirePlug(ctx, d.IP)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	// Read again: another command may have changed the value while we waited
+	cur, ok := s.deviceAt(id)
+	if !ok || cur.Uniqueid != d.Uniqueid || cur.IP != d.IP {
+		return false, errors.New("switch was reconfigured, try again")
+	}
+	d = cur
+	state := next(d.Value != 0)
+	start := time.Now()
+	confirmed, err := miOnOff(d, state)
+	s.recordExchange(d.Uniqueid, time.Since(start), err, false)
+	if err != nil {
+		s.auditFailure(ctx, d.Uniqueid, state, err)
+		return false, err
+	}
+	result := auditUnconfirmed
+	if confirmed {
+		result = auditConfirmed
+	}
+	return state, s.setonoff(ctx, d.Uniqueid, state, result)
+}
+
+func (s *sw) setonoff(ctx context.Context, uid string, state bool, result string) error {
 	sm.Lock()
+	// The device list may have been reloaded while the plug was switched
+	id := s.indexOf(uid)
+	if id < 0 {
+		sm.Unlock()
+		return errors.New("invalid switch number")
+	}
+	old := s.Devices[id].Value
 	if state {
 		s.Devices[id].Value = 1
 	} else {
 		s.Devices[id].Value = 0
 	}
+	s.Devices[id].gen++
+	events.publish(newSwitchEvent(&s.Devices[id]))
+	d := s.Devices[id]
+	entry := newAuditEntry(id, &d, old, d.Value, auditSourceFrom(ctx))
 	sm.Unlock()
-	s.miSaveSettings()
-	log.Printf("Set switch %d to %v", id+1, state)
-	return nil
+	entry.Result = result
+	auditRecord(entry)
+	loggerFrom(ctx).Info("Set switch", "device", d, "on", state, "result", result)
+	return s.miSaveState()
 }
 
+// MiGetDevices returns a copy of the device list, safe to read without sm
 func MiGetDevices() []Device {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devices
+	sm.RLock()
+	defer sm.RUnlock()
+	return slices.Clone(s.Devices)
+}
+
+// MiFindSwitch returns the id of the switch with the given uniqueid
+func MiFindSwitch(uid string) (int32, bool) {
+	sm.RLock()
+	defer sm.RUnlock()
+	id := s.indexOf(uid)
+	return id, id >= 0
+}
+
+// deviceAt returns a copy of switch id. It reports false when there is no
+// such switch, e.g. because a reload removed it after the id was checked.
+func (s *sw) deviceAt(id int32) (Device, bool) {
+	sm.RLock()
+	defer sm.RUnlock()
+	if id < 0 || int(id) >= len(s.Devices) {
+		return Device{}, false
+	}
+	return s.Devices[id], true
 }
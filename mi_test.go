@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "3ab8e0b83a1a31a7a548aa5d8a7c7fa1"
+
+// fakePlug answers the miIO hello, get_prop and set_power requests of a
+// plug on ip:54321
+type fakePlug struct {
+	conn  net.PacketConn
+	token []byte
+
+	mu   sync.Mutex
+	on   bool
+	sets int
+}
+
+func startFakePlug(t *testing.T, ip string) *fakePlug {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip, "54321"))
+	if err != nil {
+		t.Skipf("cannot listen as a plug on %s: %v", ip, err)
+	}
+	token, _ := hex.DecodeString(testToken)
+	p := &fakePlug{conn: conn, token: token}
+	t.Cleanup(func() { conn.Close() })
+	go p.serve()
+	return p
+}
+
+func (p *fakePlug) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n == 32 {
+			hello := make([]byte, 32)
+			hello[0], hello[1], hello[3] = 0x21, 0x31, 32
+			binary.BigEndian.PutUint32(hello[8:12], 4242)
+			binary.BigEndian.PutUint32(hello[12:16], uint32(time.Now().Unix()))
+			p.conn.WriteTo(hello, addr)
+			continue
+		}
+		if n < 32 || !verifyChecksum(buf[:n], p.token) {
+			continue
+		}
+		data, err := decryptPayload(buf[32:n], p.token)
+		if err != nil {
+			continue
+		}
+		var req struct {
+			ID     int      `json:"id"`
+			Method string   `json:"method"`
+			Params []string `json:"params"`
+		}
+		if json.Unmarshal(data, &req) != nil {
+			continue
+		}
+
+		p.mu.Lock()
+		var result []string
+		switch req.Method {
+		case "get_prop":
+			result = []string{"off"}
+			if p.on {
+				result[0] = "on"
+			}
+		case "set_power":
+			p.on = len(req.Params) > 0 && req.Params[0] == "on"
+			p.sets++
+			result = []string{"ok"}
+		}
+		p.mu.Unlock()
+
+		resp, _ := json.Marshal(map[string]any{"id": req.ID, "result": result})
+		enc, _ := encryptPayload(resp, p.token)
+		p.conn.WriteTo(buildPacket(p.token, buf[8:12], buf[12:16], enc), addr)
+	}
+}
+
+func (p *fakePlug) state() (on bool, sets int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on, p.sets
+}
+
+// testSettings returns a settings.json with one switch per IP, named by
+// customname, and extra top-level sections appended
+func testSettings(customname string, ips []string, extra string) string {
+	var devices []string
+	for i, ip := range ips {
+		devices = append(devices, fmt.Sprintf(`{"ip": %q, "token": %q, "name": "Switch %d", "devicetype": "Switch",
+			"number": %d, "uniqueid": "test-%d", "id": %d, "customname": "%s %d",
+			"min": 0, "max": 1, "step": 1, "canwrite": true}`, ip, testToken, i+1, i+1, i, i, customname, i))
+	}
+	if extra != "" {
+		extra = ", " + extra
+	}
+	return `{"devices": [` + strings.Join(devices, ", ") + `], "log": {"level": "error"}` + extra + `}`
+}
+
+// useTestSettings runs the test in a new directory holding settings and
+// loads them
+func useTestSettings(t *testing.T, settings string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	writeTestSettings(t, settings)
+	if err := s.miLoadSettings(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestSettings(t *testing.T, settings string) {
+	t.Helper()
+	if err := os.WriteFile(settingsFile, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentAccess reads switches, sends commands, queries the plugs and
+// reloads the settings all at once, for go test -race to check the locking
+func TestConcurrentAccess(t *testing.T) {
+	ips := []string{"127.0.0.21", "127.0.0.22"}
+	plugs := []*fakePlug{startFakePlug(t, ips[0]), startFakePlug(t, ips[1])}
+	useTestSettings(t, testSettings("Plug", ips, ""))
+
+	var mu sync.Mutex // serialises settings rewrites with reloads
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	run := func(n int, f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	run(200, func(i int) {
+		for _, d := range MiGetDevices() {
+			_ = d.displayName()
+		}
+		MiGetOnOff(int32(i % 2))
+		MiGetName(int32(i % 2))
+		MiGetSwitches()
+	})
+	for id := range plugs {
+		run(20, func(i int) {
+			if err := MiSetOnOff(ctx, int32(id), i%2 == 0); err != nil {
+				t.Errorf("switch %d: %v", id, err)
+			}
+		})
+	}
+	run(10, func(int) { s.queryDevices(nil, false) })
+	run(10, func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		writeTestSettings(t, testSettings(fmt.Sprintf("Plug v%d", i), ips, ""))
+		if err := MiReloadConfig(); err != nil {
+			t.Errorf("reload: %v", err)
+		}
+	})
+	wg.Wait()
+
+	for id, p := range plugs {
+		on, sets := p.state()
+		cached, err := MiGetOnOff(int32(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != on || sets != 20 {
+			t.Errorf("switch %d: cached %v, plug %v after %d sets, want %v after 20", id, cached, on, sets, on)
+		}
+	}
+}
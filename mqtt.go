@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client: QoS 0 publish and subscribe, a last will,
+// keep-alive pings and optional TLS. It is all the bridge needs.
+
+// MQTT control packet types, shifted into the high nibble of the first byte
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttSubscribe  = 8 << 4
+	mqttSuback     = 9 << 4
+	mqttPingreq    = 12 << 4
+	mqttPingresp   = 13 << 4
+	mqttDisconnect = 14 << 4
+)
+
+const (
+	mqttDialTimeout = 10 * time.Second
+	mqttMaxPacket   = 256 << 10 // larger packets are not expected from a broker
+)
+
+// mqttMessage is a message received on a subscribed topic, or a will
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type mqttClient struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+
+	wmu sync.Mutex // serialises writes of whole packets
+}
+
+// mqttConnackErrors explains the CONNACK return codes
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// dialMQTT connects to the broker described by c and waits for it to
+// accept the session. The will is published by the broker if the
+// connection is lost without a DISCONNECT.
+func dialMQTT(ctx context.Context, c mqttConfig, will mqttMessage, keepAlive time.Duration) (*mqttClient, error) {
+	addr, useTLS, err := parseBrokerURL(c.Broker)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: mqttDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(conn, &tls.Config{ServerName: host})
+		hctx, cancel := context.WithTimeout(ctx, mqttDialTimeout)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	cl := &mqttClient{conn: conn, r: bufio.NewReader(conn), keepAlive: keepAlive}
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if err := cl.connect(c, will); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return cl, nil
+}
+
+// parseBrokerURL accepts host:port, tcp://host[:port] or mqtt://, and
+// ssl://, tls:// or mqtts:// for TLS. It returns the address to dial.
+func parseBrokerURL(broker string) (string, bool, error) {
+	useTLS := false
+	host := broker
+	if strings.Contains(broker, "://") {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return "", false, err
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+		}
+		host = u.Host
+	}
+	if host == "" {
+		return "", false, errors.New("broker has no host")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return host, useTLS, nil
+}
+
+func (cl *mqttClient) connect(c mqttConfig, will mqttMessage) error {
+	flags := byte(0x02) // clean session
+	if will.topic != "" {
+		flags |= 0x04
+		if will.retain {
+			flags |= 0x20
+		}
+	}
+	if c.Username != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(cl.keepAlive/time.Second))
+	body = appendMQTTString(body, c.ClientID)
+	if will.topic != "" {
+		body = appendMQTTString(body, will.topic)
+		body = appendMQTTString(body, string(will.payload))
+	}
+	if c.Username != "" {
+		body = appendMQTTString(body, c.Username)
+		if c.Password != "" {
+			body = appendMQTTString(body, c.Password)
+		}
+	}
+	if err := cl.write(mqttConnect, body); err != nil {
+		return err
+	}
+
+	header, resp, err := cl.readPacket()
+	if err != nil {
+		return err
+	}
+	if header&0xF0 != mqttConnack || len(resp) != 2 {
+		return errors.New("broker did not acknowledge the connection")
+	}
+	if rc := resp[1]; rc != 0 {
+		if msg, ok := mqttConnackErrors[rc]; ok {
+			return fmt.Errorf("broker refused the connection: %s", msg)
+		}
+		return fmt.Errorf("broker refused the connection with code %d", rc)
+	}
+	return nil
+}
+
+// publish sends a QoS 0 message
+func (cl *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	return cl.write(header, append(body, payload...))
+}
+
+// subscribe asks for the given topic filters at QoS 0. The broker's SUBACK
+// is checked by readMessage.
+func (cl *mqttClient) subscribe(filters ...string) error {
+	body := binary.BigEndian.AppendUint16(nil, 1)
+	for _, f := range filters {
+		body = appendMQTTString(body, f)
+		body = append(body, 0)
+	}
+	return cl.write(mqttSubscribe|0x02, body)
+}
+
+func (cl *mqttClient) ping() error {
+	return cl.write(mqttPingreq, nil)
+}
+
+// disconnect ends the session cleanly, so the broker does not publish the will
+func (cl *mqttClient) disconnect() {
+	cl.write(mqttDisconnect, nil)
+	cl.conn.Close()
+}
+
+func (cl *mqttClient) close() error {
+	return cl.conn.Close()
+}
+
+// readMessage returns the next message published to a subscribed topic,
+// answering and skipping other packets. A broker that stays silent for
+// longer than 1.5 keep-alive periods is considered gone.
+func (cl *mqttClient) readMessage() (mqttMessage, error) {
+	for {
+		cl.conn.SetReadDeadline(time.Now().Add(cl.keepAlive * 3 / 2))
+		header, body, err := cl.readPacket()
+		if err != nil {
+			return mqttMessage{}, err
+		}
+		switch header & 0xF0 {
+		case mqttPublish:
+			return cl.parsePublish(header, body)
+		case mqttSuback:
+			for _, rc := range body[min(2, len(body)):] {
+				if rc == 0x80 {
+					return mqttMessage{}, errors.New("broker refused the subscription")
+				}
+			}
+		case mqttPingresp, mqttPuback:
+		default:
+			return mqttMessage{}, fmt.Errorf("unexpected MQTT packet type %d", header>>4)
+		}
+	}
+}
+
+func (cl *mqttClient) parsePublish(header byte, body []byte) (mqttMessage, error) {
+	if len(body) < 2 {
+		return mqttMessage{}, errors.New("short MQTT PUBLISH packet")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return mqttMessage{}, errors.New("short MQTT PUBLISH packet")
+	}
+	m := mqttMessage{topic: string(body[2 : 2+n]), retain: header&0x01 != 0}
+	rest := body[2+n:]
+	if qos := header >> 1 & 0x03; qos > 0 {
+		// The subscription asked for QoS 0, but acknowledge anyway
+		if len(rest) < 2 {
+			return mqttMessage{}, errors.New("short MQTT PUBLISH packet")
+		}
+		if qos == 1 {
+			if err := cl.write(mqttPuback, rest[:2]); err != nil {
+				return mqttMessage{}, err
+			}
+		}
+		rest = rest[2:]
+	}
+	m.payload = rest
+	return m, nil
+}
+
+func (cl *mqttClient) write(header byte, body []byte) error {
+	pkt := []byte{header}
+	pkt = appendRemainingLength(pkt, len(body))
+	pkt = append(pkt, body...)
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	cl.conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	_, err := cl.conn.Write(pkt)
+	return err
+}
+
+func (cl *mqttClient) readPacket() (byte, []byte, error) {
+	header, err := cl.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		b, err := cl.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(cl.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
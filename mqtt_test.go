@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const mqttTestTimeout = 5 * time.Second
+
+// testBroker is just enough of an MQTT broker to watch the bridge: it
+// accepts every connection and hands each to the test
+type testBroker struct {
+	ln    net.Listener
+	conns chan *brokerConn
+}
+
+// brokerConn is one client session seen by the test broker
+type brokerConn struct {
+	*mqttClient
+	clientID, username, password string
+	will                         mqttMessage
+
+	published  chan mqttMessage
+	subscribed chan string
+	backlog    []mqttMessage // published messages not waited for yet
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, conns: make(chan *brokerConn, 4)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	bc := &brokerConn{
+		mqttClient: &mqttClient{conn: conn, r: bufio.NewReader(conn)},
+		published:  make(chan mqttMessage, 64),
+		subscribed: make(chan string, 4),
+	}
+	header, body, err := bc.readPacket()
+	if err != nil || header&0xF0 != mqttConnect || bc.parseConnect(body) != nil {
+		return
+	}
+	if bc.write(mqttConnack, []byte{0, 0}) != nil {
+		return
+	}
+	b.conns <- bc
+
+	for {
+		header, body, err := bc.readPacket()
+		if err != nil {
+			return
+		}
+		switch header & 0xF0 {
+		case mqttPublish:
+			m, err := bc.parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			bc.published <- m
+		case mqttSubscribe:
+			// Packet id, then filters each followed by a QoS byte
+			ack := append([]byte(nil), body[:2]...)
+			for rest := body[2:]; len(rest) > 2; {
+				f, n := readMQTTString(rest)
+				bc.subscribed <- f
+				rest = rest[min(n+1, len(rest)):]
+				ack = append(ack, 0)
+			}
+			bc.write(mqttSuback, ack)
+		case mqttPingreq:
+			bc.write(mqttPingresp, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func (bc *brokerConn) parseConnect(body []byte) error {
+	if len(body) < 10 {
+		return errors.New("short CONNECT")
+	}
+	flags := body[7]
+	var fields []string
+	for rest := body[10:]; len(rest) >= 2; {
+		f, n := readMQTTString(rest)
+		fields = append(fields, f)
+		rest = rest[n:]
+	}
+	next := func() string {
+		if len(fields) == 0 {
+			return ""
+		}
+		f := fields[0]
+		fields = fields[1:]
+		return f
+	}
+	bc.clientID = next()
+	if flags&0x04 != 0 {
+		bc.will = mqttMessage{topic: next(), payload: []byte(next()), retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		bc.username = next()
+	}
+	if flags&0x40 != 0 {
+		bc.password = next()
+	}
+	return nil
+}
+
+// readMQTTString returns a length-prefixed string and the bytes it took
+func readMQTTString(b []byte) (string, int) {
+	n := min(int(binary.BigEndian.Uint16(b)), len(b)-2)
+	return string(b[2 : 2+n]), 2 + n
+}
+
+func (b *testBroker) accept(t *testing.T) *brokerConn {
+	t.Helper()
+	select {
+	case bc := <-b.conns:
+		return bc
+	case <-time.After(mqttTestTimeout):
+		t.Fatal("the bridge did not connect")
+		return nil
+	}
+}
+
+// send publishes a message to the client, as if another client had
+func (bc *brokerConn) send(t *testing.T, topic, payload string, retain bool) {
+	t.Helper()
+	header := byte(mqttPublish)
+	if retain {
+		header |= 0x01
+	}
+	if err := bc.write(header, append(appendMQTTString(nil, topic), payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor returns the next message the client publishes on topic. Messages
+// on other topics are kept for later calls.
+func (bc *brokerConn) waitFor(t *testing.T, topic string) mqttMessage {
+	t.Helper()
+	for i, m := range bc.backlog {
+		if m.topic == topic {
+			bc.backlog = append(bc.backlog[:i], bc.backlog[i+1:]...)
+			return m
+		}
+	}
+	timeout := time.After(mqttTestTimeout)
+	for {
+		select {
+		case m := <-bc.published:
+			if m.topic == topic {
+				return m
+			}
+			bc.backlog = append(bc.backlog, m)
+		case <-timeout:
+			t.Fatalf("nothing published on %s", topic)
+		}
+	}
+}
+
+func (bc *brokerConn) waitSubscribed(t *testing.T, filter string) {
+	t.Helper()
+	select {
+	case f := <-bc.subscribed:
+		if f != filter {
+			t.Fatalf("subscribed to %s, want %s", f, filter)
+		}
+	case <-time.After(mqttTestTimeout):
+		t.Fatalf("no subscription to %s", filter)
+	}
+}
+
+func expectMessage(t *testing.T, m mqttMessage, payload string, retain bool) {
+	t.Helper()
+	if string(m.payload) != payload || m.retain != retain {
+		t.Errorf("%s: got %q retained %v, want %q retained %v", m.topic, m.payload, m.retain, payload, retain)
+	}
+}
+
+// TestMQTTBridge runs the bridge against the test broker: the session it
+// opens, what it publishes, the commands it takes and how it reconnects
+func TestMQTTBridge(t *testing.T) {
+	plug := startFakePlug(t, "127.0.0.31")
+	broker := startTestBroker(t)
+	mqtt := fmt.Sprintf(`"mqtt": {"broker": %q, "username": "user", "password": "secret", "topic": "test/mi"}`, broker.ln.Addr())
+	useTestSettings(t, testSettings("Plug", []string{"127.0.0.31"}, mqtt))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		MiStartMQTT(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	bc := broker.accept(t)
+	if bc.clientID != defaultMQTTClientID || bc.username != "user" || bc.password != "secret" {
+		t.Errorf("connected as %q with %q/%q", bc.clientID, bc.username, bc.password)
+	}
+	if bc.will.topic != "test/mi/status" || string(bc.will.payload) != "offline" || !bc.will.retain {
+		t.Errorf("will %s %q retained %v", bc.will.topic, bc.will.payload, bc.will.retain)
+	}
+
+	expectMessage(t, bc.waitFor(t, "test/mi/status"), "online", true)
+	bc.waitSubscribed(t, "test/mi/+/set")
+	expectMessage(t, bc.waitFor(t, "test/mi/test-0/state"), "OFF", true)
+	expectMessage(t, bc.waitFor(t, "test/mi/test-0/availability"), "online", true)
+
+	m := bc.waitFor(t, "homeassistant/switch/test_mi/test-0/config")
+	var cfg haConfig
+	if err := json.Unmarshal(m.payload, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !m.retain || cfg.CommandTopic != "test/mi/test-0/set" || cfg.StateTopic != "test/mi/test-0/state" || cfg.Name != "Plug 0" {
+		t.Errorf("discovery config %s retained %v", m.payload, m.retain)
+	}
+
+	// A retained command is ignored, a live one switches the plug
+	bc.send(t, "test/mi/test-0/set", "ON", true)
+	bc.send(t, "test/mi/test-0/set", "on", false)
+	expectMessage(t, bc.waitFor(t, "test/mi/test-0/state"), "ON", true)
+	if on, sets := plug.state(); !on || sets != 1 {
+		t.Errorf("plug on %v after %d sets, want on after 1", on, sets)
+	}
+	// The audit entry is written just after the state event
+	var entries []auditEntry
+	for deadline := time.Now().Add(mqttTestTimeout); len(entries) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var err error
+		if entries, err = readAuditLog(auditQuery{UniqueID: "test-0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entries) != 1 || entries[0].Source.Kind != sourceMQTT || entries[0].New != 1 {
+		t.Errorf("audit log %+v, want one mqtt entry switching on", entries)
+	}
+
+	// Commands that arrive while the plug is busy collapse into the latest:
+	// one may already be waiting for the plug, then only the last is sent
+	_, before := plug.state()
+	release, err := acquirePlug(ctx, "127.0.0.31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"off", "on", "off", "on", "off"} {
+		bc.send(t, "test/mi/test-0/set", p, false)
+	}
+	time.Sleep(50 * time.Millisecond) // let the bridge queue them
+	release()
+	expectMessage(t, bc.waitFor(t, "test/mi/test-0/state"), "OFF", true)
+	// Wait for a command still on its way to the plug
+	if release, err = acquirePlug(ctx, "127.0.0.31"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if on, sets := plug.state(); on || sets-before > 2 {
+		t.Errorf("plug on %v after %d sets for 5 queued commands, want off after at most 2", on, sets-before)
+	}
+
+	// When the broker drops the connection the bridge comes back and
+	// publishes the current state again
+	bc.conn.Close()
+	bc = broker.accept(t)
+	expectMessage(t, bc.waitFor(t, "test/mi/status"), "online", true)
+	bc.waitSubscribed(t, "test/mi/+/set")
+	expectMessage(t, bc.waitFor(t, "test/mi/test-0/state"), "OFF", true)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// mqttConfig is the optional mqtt section of settings.json. The bridge is
+// off while broker is empty.
+type mqttConfig struct {
+	Broker          string `json:"broker,omitempty"`   // host:port, tcp://host:port or, for TLS, ssl://host:port
+	ClientID        string `json:"clientid,omitempty"` // default mi_alpaca
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	Topic           string `json:"topic,omitempty"`           // topic prefix, default mi_alpaca
+	Discovery       *bool  `json:"discovery,omitempty"`       // publish Home Assistant discovery configs, default true
+	DiscoveryPrefix string `json:"discoveryprefix,omitempty"` // default homeassistant
+}
+
+const (
+	defaultMQTTClientID        = "mi_alpaca"
+	defaultMQTTTopic           = "mi_alpaca"
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+
+	mqttKeepAlive    = 60 * time.Second
+	mqttPingInterval = 30 * time.Second
+	mqttMaxBackoff   = time.Minute
+)
+
+// withDefaults fills in the optional mqtt settings
+func (c mqttConfig) withDefaults() mqttConfig {
+	if c.ClientID == "" {
+		c.ClientID = defaultMQTTClientID
+	}
+	if c.Topic == "" {
+		c.Topic = defaultMQTTTopic
+	}
+	if c.Discovery == nil {
+		on := true
+		c.Discovery = &on
+	}
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = defaultMQTTDiscoveryPrefix
+	}
+	return c
+}
+
+// errMQTTReconfigured ends a session whose settings were changed by a reload
+var errMQTTReconfigured = errors.New("mqtt settings changed")
+
+// mqttChanged is signalled when a reload changes the mqtt section
+var mqttChanged = make(chan struct{}, 1)
+
+// setMQTTConfig stores c and wakes the bridge when it differs from the
+// running settings. The caller must hold sm.
+func (s *sw) setMQTTConfig(c mqttConfig) {
+	if reflect.DeepEqual(s.mqtt, c) {
+		return
+	}
+	s.mqtt = c
+	select {
+	case mqttChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sw) mqttConfig() mqttConfig {
+	sm.RLock()
+	defer sm.RUnlock()
+	return s.mqtt
+}
+
+// MiStartMQTT runs the MQTT bridge until ctx is cancelled, reconnecting
+// with backoff when the broker goes away
+func MiStartMQTT(ctx context.Context) {
+	backoff := time.Second
+	for {
+		// This session starts from the current settings
+		select {
+		case <-mqttChanged:
+		default:
+		}
+		c := s.mqttConfig()
+		var wait <-chan time.Time
+		if c.Broker != "" {
+			connected, err := runMQTTBridge(ctx, c.withDefaults())
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				backoff = time.Second
+			}
+			if !errors.Is(err, errMQTTReconfigured) {
+				slog.Warn("MQTT connection lost", "broker", c.Broker, "error", err, "retry", backoff)
+				wait = time.After(backoff)
+				backoff = min(backoff*2, mqttMaxBackoff)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-mqttChanged:
+			backoff = time.Second
+		case <-wait:
+		}
+	}
+}
+
+// mqttBridge publishes switch states to one broker session and turns
+// messages on the set topics into switch commands
+type mqttBridge struct {
+	cl        *mqttClient
+	c         mqttConfig
+	announced map[string]switchState     // last discovery config published per uniqueid
+	published map[string]switchState     // last state published per uniqueid
+	commands  map[string]chan setCommand // pending command per uniqueid, see queueSet
+}
+
+// setCommand is a checked message on a set topic
+type setCommand struct {
+	uid   string
+	on    bool
+	topic string
+}
+
+func (b *mqttBridge) statusTopic() string {
+	return b.c.Topic + "/status"
+}
+
+func (b *mqttBridge) switchTopic(uid, leaf string) string {
+	return b.c.Topic + "/" + uid + "/" + leaf
+}
+
+// runMQTTBridge connects to the broker and serves it until the connection
+// fails, the settings change or ctx is cancelled. It reports whether the
+// broker accepted the connection.
+func runMQTTBridge(ctx context.Context, c mqttConfig) (bool, error) {
+	b := &mqttBridge{
+		c:         c,
+		announced: make(map[string]switchState),
+		published: make(map[string]switchState),
+		commands:  make(map[string]chan setCommand),
+	}
+	will := mqttMessage{topic: b.statusTopic(), payload: []byte("offline"), retain: true}
+	cl, err := dialMQTT(ctx, c, will, mqttKeepAlive)
+	if err != nil {
+		return false, err
+	}
+	defer cl.close()
+	b.cl = cl
+	slog.Info("MQTT connected", "broker", c.Broker, "topic", c.Topic)
+
+	if err := cl.publish(b.statusTopic(), []byte("online"), true); err != nil {
+		return true, err
+	}
+	if err := cl.subscribe(c.Topic + "/+/set"); err != nil {
+		return true, err
+	}
+
+	ch, replay := subscribeEvents()
+	defer func() { events.unsubscribe(ch) }()
+	if err := b.handleEvents(replay); err != nil {
+		return true, err
+	}
+
+	msgs := make(chan mqttMessage)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	session, endSession := context.WithCancel(ctx)
+	defer endSession()
+	go func() {
+		for {
+			m, err := cl.readMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(mqttPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			b.goodbye()
+			return true, nil
+		case <-mqttChanged:
+			b.goodbye()
+			return true, errMQTTReconfigured
+		case e, ok := <-ch:
+			if ok {
+				err = b.handleEvent(e)
+				break
+			}
+			if ctx.Err() != nil {
+				ch = nil // shutting down, wait for ctx.Done
+				continue
+			}
+			// Dropped for falling behind; start over from the current state
+			ch, replay = subscribeEvents()
+			err = b.handleEvents(replay)
+		case m := <-msgs:
+			b.queueSet(ctx, session, m)
+		case err = <-readErr:
+		case <-ping.C:
+			err = cl.ping()
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// goodbye marks the bridge offline and ends the session cleanly
+func (b *mqttBridge) goodbye() {
+	b.cl.publish(b.statusTopic(), []byte("offline"), true)
+	b.cl.disconnect()
+}
+
+func (b *mqttBridge) handleEvents(list []stateEvent) error {
+	for _, e := range list {
+		if err := b.handleEvent(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleEvent publishes what changed about a switch
+func (b *mqttBridge) handleEvent(e stateEvent) error {
+	st := e.state
+	if st == nil {
+		return nil
+	}
+	if *b.c.Discovery {
+		if prev, ok := b.announced[st.UniqueID]; !ok || prev.Name != st.Name || prev.CanWrite != st.CanWrite {
+			if err := b.announce(st); err != nil {
+				return err
+			}
+			b.announced[st.UniqueID] = *st
+		}
+	}
+
+	prev, ok := b.published[st.UniqueID]
+	if !ok || prev.Value != st.Value {
+		if err := b.cl.publish(b.switchTopic(st.UniqueID, "state"), mqttPayload(st.Value != 0), true); err != nil {
+			return err
+		}
+	}
+	if !ok || prev.Online != st.Online {
+		availability := "online"
+		if !st.Online {
+			availability = "offline"
+		}
+		if err := b.cl.publish(b.switchTopic(st.UniqueID, "availability"), []byte(availability), true); err != nil {
+			return err
+		}
+	}
+	b.published[st.UniqueID] = *st
+	return nil
+}
+
+func mqttPayload(on bool) []byte {
+	if on {
+		return []byte("ON")
+	}
+	return []byte("OFF")
+}
+
+// haAvailability and haDevice are parts of a Home Assistant discovery config
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// haConfig is a Home Assistant MQTT discovery config for one switch
+type haConfig struct {
+	Name             string           `json:"name"`
+	UniqueID         string           `json:"unique_id"`
+	StateTopic       string           `json:"state_topic"`
+	CommandTopic     string           `json:"command_topic,omitempty"`
+	PayloadOn        string           `json:"payload_on"`
+	PayloadOff       string           `json:"payload_off"`
+	Availability     []haAvailability `json:"availability"`
+	AvailabilityMode string           `json:"availability_mode"`
+	Device           haDevice         `json:"device"`
+}
+
+// announce publishes the Home Assistant discovery config of a switch.
+// Switches that cannot be written show up as binary sensors.
+func (b *mqttBridge) announce(st *switchState) error {
+	component := "switch"
+	cfg := haConfig{
+		Name:       st.Name,
+		UniqueID:   "mi_alpaca_" + st.UniqueID,
+		StateTopic: b.switchTopic(st.UniqueID, "state"),
+		PayloadOn:  "ON",
+		PayloadOff: "OFF",
+		Availability: []haAvailability{
+			{Topic: b.statusTopic()},
+			{Topic: b.switchTopic(st.UniqueID, "availability")},
+		},
+		AvailabilityMode: "all",
+		Device: haDevice{
+			Identifiers:  []string{st.UniqueID},
+			Name:         st.Name,
+			Manufacturer: "Xiaomi",
+			Model:        st.Model,
+		},
+	}
+	if st.CanWrite {
+		cfg.CommandTopic = b.switchTopic(st.UniqueID, "set")
+	} else {
+		component = "binary_sensor"
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return b.cl.publish(b.discoveryTopic(component, st.UniqueID), data, true)
+}
+
+// discoveryTopic is <discoveryprefix>/<component>/<node_id>/<uniqueid>/config,
+// with the topic prefix as node_id so that two servers on one broker do not
+// overwrite each other's configs. Home Assistant allows only letters,
+// digits, _ and - in a node_id.
+func (b *mqttBridge) discoveryTopic(component, uid string) string {
+	node := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, b.c.Topic)
+	return b.c.DiscoveryPrefix + "/" + component + "/" + node + "/" + uid + "/config"
+}
+
+// queueSet checks a message on <topic>/<uniqueid>/set and hands it to the
+// worker of that switch, which runs until session ends. A slow plug must not
+// hold up events and pings, and holds up at most one command per switch: a
+// newer command replaces the one still waiting.
+func (b *mqttBridge) queueSet(ctx, session context.Context, m mqttMessage) {
+	cmd, ok := b.parseSet(m)
+	if !ok {
+		return
+	}
+	q, ok := b.commands[cmd.uid]
+	if !ok {
+		q = make(chan setCommand, 1)
+		b.commands[cmd.uid] = q
+		go func() {
+			for {
+				select {
+				case cmd := <-q:
+					b.handleSet(ctx, cmd)
+				case <-session.Done():
+					return
+				}
+			}
+		}()
+	}
+	// Only this goroutine sends, so after the drain there is room
+	select {
+	case old := <-q:
+		slog.Debug("Replacing MQTT command not sent yet", "topic", m.topic, "on", old.on)
+	default:
+	}
+	q <- cmd
+}
+
+// parseSet checks a message on <topic>/<uniqueid>/set. Retained messages,
+// unknown payloads and unknown or read-only switches are logged and
+// ignored.
+func (b *mqttBridge) parseSet(m mqttMessage) (setCommand, bool) {
+	l := slog.Default().With("topic", m.topic)
+	// A retained command would switch the plug again on every reconnect
+	if m.retain {
+		l.Warn("Ignoring retained MQTT command")
+		return setCommand{}, false
+	}
+	cmd := setCommand{
+		uid:   strings.TrimSuffix(strings.TrimPrefix(m.topic, b.c.Topic+"/"), "/set"),
+		topic: m.topic,
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(m.payload))) {
+	case "on", "1", "true":
+		cmd.on = true
+	case "off", "0", "false":
+	default:
+		l.Warn("Ignoring MQTT command with unknown payload", "payload", string(m.payload))
+		return setCommand{}, false
+	}
+
+	id, ok := MiFindSwitch(cmd.uid)
+	if !ok {
+		l.Warn("Ignoring MQTT command for unknown switch")
+		return setCommand{}, false
+	}
+	if !MiGetCanWrite(id) {
+		l.Warn("Ignoring MQTT command for read-only switch", "switch", id)
+		return setCommand{}, false
+	}
+	return cmd, true
+}
+
+// handleSet switches a plug for a command from queueSet. It goes through
+// MiSetOnOff like an Alpaca request, so the plug queue, audit log and events
+// see it too.
+func (b *mqttBridge) handleSet(ctx context.Context, cmd setCommand) {
+	l := slog.Default().With("topic", cmd.topic)
+	// The settings may have been reloaded while the command waited
+	id, ok := MiFindSwitch(cmd.uid)
+	if !ok {
+		l.Warn("Ignoring MQTT command for a switch that was removed")
+		return
+	}
+
+	ctx = withLogger(ctx, l)
+	ctx = withAuditSource(ctx, auditSource{Kind: sourceMQTT})
+	if err := MiSetOnOff(ctx, id, cmd.on); err != nil {
+		l.Warn("MQTT command failed", "switch", id, "error", err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// joinIPv6Group adds the multicast group on ifi to the groups conn receives
+func joinIPv6Group(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], group.To16())
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptIPv6Mreq(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Every exchange with a plug goes through the queue of its IP address, so
+// commands to one plug never interleave their handshakes and stamps while
+// different plugs are talked to in parallel.
+var (
+	plugQueuesMu sync.Mutex
+	plugQueues   = map[string]chan struct{}{}
+)
+
+// plugWaitTimeout bounds the wait for a plug even when ctx has no deadline,
+// so commands cannot pile up behind a plug that hangs. One exchange takes a
+// few seconds at most. A variable so tests can shorten it.
+var plugWaitTimeout = 30 * time.Second
+
+var errPlugBusy = errors.New("plug is busy, gave up waiting")
+
+// acquirePlug waits until the plug at ip is free, ctx is done or
+// plugWaitTimeout has passed, and returns the function that releases it
+func acquirePlug(ctx context.Context, ip string) (func(), error) {
+	plugQueuesMu.Lock()
+	q, ok := plugQueues[ip]
+	if !ok {
+		q = make(chan struct{}, 1)
+		plugQueues[ip] = q
+	}
+	plugQueuesMu.Unlock()
+
+	timeout := time.NewTimer(plugWaitTimeout)
+	defer timeout.Stop()
+	select {
+	case q <- struct{}{}:
+		return func() { <-q }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout.C:
+		return nil, errPlugBusy
+	}
+}
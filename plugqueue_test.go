@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquirePlug(t *testing.T) {
+	old := plugWaitTimeout
+	plugWaitTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { plugWaitTimeout = old })
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		busy bool
+		ctx  context.Context
+		want error
+	}{
+		{"free plug", false, context.Background(), nil},
+		{"busy plug without a deadline", true, context.Background(), errPlugBusy},
+		{"busy plug and cancelled", true, cancelled, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const ip = "192.0.2.1"
+			if tt.busy {
+				release, err := acquirePlug(context.Background(), ip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer release()
+			}
+			release, err := acquirePlug(tt.ctx, ip)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil {
+				release()
+			}
+		})
+	}
+}
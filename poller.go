@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// MiStartPoller refreshes every switch from the hardware at the configured
+// interval until ctx is cancelled, so changes made with a plug's own button
+// or another app show up in the cache. The interval is read again after each
+// round so a reloaded configuration takes effect without a restart.
+func MiStartPoller(ctx context.Context) {
+	timer := time.NewTimer(s.pollWait())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if s.pollInterval() > 0 {
+			s.pollDevices()
+		}
+		timer.Reset(s.pollWait())
+	}
+}
+
+// pollWait returns the time until the next round. While polling is disabled
+// the configuration is looked at again after defaultPollInterval.
+func (s *sw) pollWait() time.Duration {
+	if d := s.pollInterval(); d > 0 {
+		return d
+	}
+	return defaultPollInterval
+}
+
+// pollInterval returns the configured polling interval, 0 when disabled
+func (s *sw) pollInterval() time.Duration {
+	sm.RLock()
+	defer sm.RUnlock()
+	if s.poll.Interval == nil {
+		return defaultPollInterval
+	}
+	return time.Duration(*s.poll.Interval)
+}
+
+// pollDevices queries every switch once and saves the state if any changed
+func (s *sw) pollDevices() {
+	if err := beginDeviceOp(); err != nil {
+		return
+	}
+	defer endDeviceOp()
+
+	if s.queryDevices(nil, false) {
+		if err := s.miSaveState(); err != nil {
+			slog.Warn("Failed to save state", "error", err)
+		}
+	}
+}
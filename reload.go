@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval is how often settings.json is checked for changes
+const reloadCheckInterval = 2 * time.Second
+
+// reloadMu serialises reloads started by SIGHUP and by the file watcher
+var reloadMu sync.Mutex
+
+// MiReloadConfig re-reads settings.json and swaps the new device list in.
+// Devices whose uniqueid, IP and token are unchanged keep their running
+// state; added devices and devices pointing at a different plug are queried.
+// An invalid file is reported and the running configuration is kept.
+func MiReloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig(settingsFile)
+	if err != nil {
+		return err
+	}
+	if err := configureLogging(cfg.Log); err != nil {
+		return fmt.Errorf("log settings: %w", err)
+	}
+
+	sm.RLock()
+	remembered := s.switchIDs
+	sm.RUnlock()
+	// May talk to new plugs, so it runs before the lock is taken
+	switchIDs, err := resolveSwitchIDs(cfg.Devices, remembered)
+	if err != nil {
+		return err
+	}
+
+	sm.Lock()
+	old := make(map[string]Device, len(s.Devices))
+	for _, d := range s.Devices {
+		old[d.Uniqueid] = d
+	}
+
+	devices := cfg.Devices
+	var query []int32
+	var added, changed int
+	for i := range devices {
+		d := &devices[i]
+		prev, ok := old[d.Uniqueid]
+		switch {
+		case !ok:
+			added++
+			query = append(query, int32(i))
+		case prev.IP != d.IP || prev.Token != d.Token:
+			changed++
+			query = append(query, int32(i))
+		default:
+			d.Value = prev.Value
+			d.health = prev.health
+		}
+		// A name set through SetSwitchName keeps overriding the file
+		if ok && prev.stateName != "" {
+			d.Customname = prev.stateName
+			d.stateName = prev.stateName
+		}
+		delete(old, d.Uniqueid)
+	}
+	s.Devices = devices
+	for i := range devices {
+		events.publish(newSwitchEvent(&devices[i]))
+	}
+	s.switchIDs = switchIDs
+	s.poll = cfg.Poll.withDefaults()
+	s.setMQTTConfig(cfg.MQTT)
+	s.auth = cfg.Auth
+	s.auth.warnLegacySecrets()
+	s.access = cfg.Access.rules()
+	sm.Unlock()
+
+	slog.Info("Reloaded settings", "file", settingsFile, "devices", len(devices), "added", added, "removed", len(old), "readdressed", changed)
+
+	if len(query) > 0 && beginDeviceOp() == nil {
+		s.queryDevices(query, true)
+		endDeviceOp()
+	}
+	return s.miSaveState()
+}
+
+// watchSettings reloads the configuration whenever settings.json changes on
+// disk. A change is applied once the file has stopped changing for one
+// interval so a half-saved file from an editor is not picked up.
+func watchSettings(ctx context.Context, interval time.Duration) {
+	last, _ := os.Stat(settingsFile)
+	var pending os.FileInfo
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(settingsFile)
+		if err != nil {
+			continue
+		}
+		if sameFile(fi, last) {
+			pending = nil
+			continue
+		}
+		if pending == nil || !sameFile(fi, pending) {
+			pending = fi
+			continue
+		}
+
+		last, pending = fi, nil
+		if err := MiReloadConfig(); err != nil {
+			logConfigErrors("Not reloading settings, keeping the running configuration", err)
+		}
+	}
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// restSwitch is a switch as returned by the REST API
+type restSwitch struct {
+	Id          int32      `json:"id"`
+	UniqueID    string     `json:"uniqueid"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Value       int64      `json:"value"`
+	Min         int64      `json:"min"`
+	Max         int64      `json:"max"`
+	CanWrite    bool       `json:"canwrite"`
+	Health      restHealth `json:"health"`
+}
+
+type restHealth struct {
+	Online              bool    `json:"online"`
+	LastSeen            string  `json:"lastseen,omitempty"`
+	LastError           string  `json:"lasterror,omitempty"`
+	LastErrorTime       string  `json:"lasterrortime,omitempty"`
+	ConsecutiveFailures int     `json:"consecutivefailures"`
+	RoundTripMs         float64 `json:"roundtripms"`
+}
+
+// restUpdate is the body of PATCH and PUT; fields left out are not changed
+type restUpdate struct {
+	Value *int64  `json:"value"`
+	Name  *string `json:"name"`
+}
+
+// maxRestBody is far more than any valid body needs
+const maxRestBody = 64 << 10
+
+// restCycle is the optional body of a cycle request
+type restCycle struct {
+	Delay *duration `json:"delay"` // time the switch stays off, default 5s
+}
+
+// configureRestAPI sets up the REST routes
+func (srv *ApiServer) configureRestAPI(router *httprouter.Router) {
+	router.GET("/v1/switches", srv.handleRestList)
+	router.GET("/v1/switches/:id", srv.handleRestGet)
+	router.PATCH("/v1/switches/:id", srv.handleRestUpdate)
+	router.PUT("/v1/switches/:id", srv.handleRestUpdate)
+	router.POST("/v1/switches/:id/toggle", srv.handleRestToggle)
+	router.POST("/v1/switches/:id/cycle", srv.handleRestCycle)
+}
+
+// MiGetSwitches returns every switch with its health
+func MiGetSwitches() []restSwitch {
+	sm.RLock()
+	defer sm.RUnlock()
+	val := make([]restSwitch, len(s.Devices))
+	for i := range s.Devices {
+		val[i] = s.Devices[i].restView(int32(i))
+	}
+	return val
+}
+
+// MiGetSwitch returns switch id with its health
+func MiGetSwitch(id int32) (restSwitch, bool) {
+	sm.RLock()
+	defer sm.RUnlock()
+	if id < 0 || int(id) >= len(s.Devices) {
+		return restSwitch{}, false
+	}
+	return s.Devices[id].restView(id), true
+}
+
+// restView returns the REST form of switch i. The caller must hold sm.
+func (d *Device) restView(i int32) restSwitch {
+	h := d.health.view(i, d.displayName())
+	return restSwitch{
+		Id:          i,
+		UniqueID:    d.Uniqueid,
+		Name:        d.displayName(),
+		Description: d.displayName(),
+		Value:       d.Value,
+		Min:         d.Min,
+		Max:         d.Max,
+		CanWrite:    d.Canwrite,
+		Health: restHealth{
+			Online:              h.Online,
+			LastSeen:            h.LastSeen,
+			LastError:           h.LastError,
+			LastErrorTime:       h.LastErrorTime,
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			RoundTripMs:         h.RoundTripMs,
+		},
+	}
+}
+
+// handleRestList returns all switches
+func (srv *ApiServer) handleRestList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, MiGetSwitches())
+}
+
+// handleRestGet returns one switch
+func (srv *ApiServer) handleRestGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := restSwitchID(w, ps)
+	if !ok {
+		return
+	}
+	writeRestSwitch(w, id)
+}
+
+// handleRestUpdate changes the value and/or name of a switch
+func (srv *ApiServer) handleRestUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := restSwitchID(w, ps)
+	if !ok {
+		return
+	}
+	var u restUpdate
+	if err := decodeRestBody(w, r, &u); err != nil && !errors.Is(err, io.EOF) {
+		writeRestError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if u.Value == nil && u.Name == nil {
+		writeRestError(w, http.StatusBadRequest, "body must set value or name")
+		return
+	}
+	if u.Value != nil {
+		if !MiGetCanWrite(id) {
+			writeRestError(w, http.StatusForbidden, "switch is read-only")
+			return
+		}
+		if lo, hi := MiGetMin(id), MiGetMax(id); *u.Value < lo || *u.Value > hi {
+			writeRestError(w, http.StatusBadRequest, fmt.Sprintf("value must be between %d and %d", lo, hi))
+			return
+		}
+	}
+
+	// The body is valid; switch the plug before renaming it, so a plug that
+	// does not answer leaves the switch unchanged
+	if u.Value != nil {
+		if err := MiSetOnOff(restContext(r), id, *u.Value != 0); err != nil {
+			writeRestError(w, restErrorStatus(err), err.Error())
+			return
+		}
+	}
+	if u.Name != nil {
+		if err := MiSetName(id, *u.Name); err != nil {
+			writeRestError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeRestSwitch(w, id)
+}
+
+// handleRestToggle turns a switch over
+func (srv *ApiServer) handleRestToggle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := restWritableSwitchID(w, ps)
+	if !ok {
+		return
+	}
+	if _, err := MiToggle(restContext(r), id); err != nil {
+		writeRestError(w, restErrorStatus(err), err.Error())
+		return
+	}
+	writeRestSwitch(w, id)
+}
+
+// handleRestCycle turns a switch off and on again after a delay
+func (srv *ApiServer) handleRestCycle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := restWritableSwitchID(w, ps)
+	if !ok {
+		return
+	}
+	var c restCycle
+	if err := decodeRestBody(w, r, &c); err != nil && !errors.Is(err, io.EOF) {
+		writeRestError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	delay := defaultCycleDelay
+	if c.Delay != nil {
+		delay = time.Duration(*c.Delay)
+	}
+	if delay <= 0 || delay > maxCycleDelay {
+		writeRestError(w, http.StatusBadRequest, fmt.Sprintf("delay must be greater than 0 and at most %s", maxCycleDelay))
+		return
+	}
+
+	if err := MiCycle(restContext(r), id, delay); err != nil {
+		writeRestError(w, restErrorStatus(err), err.Error())
+		return
+	}
+	writeRestSwitch(w, id)
+}
+
+// restSwitchID returns the switch id of the request, answering 404 when
+// there is no such switch
+func restSwitchID(w http.ResponseWriter, ps httprouter.Params) (int32, bool) {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 32)
+	if err != nil || id < 0 || id >= int64(MiGetMaxSwitch()) {
+		writeRestError(w, http.StatusNotFound, "no such switch")
+		return 0, false
+	}
+	return int32(id), true
+}
+
+// restWritableSwitchID is restSwitchID for commands, answering 403 for a
+// read-only switch
+func restWritableSwitchID(w http.ResponseWriter, ps httprouter.Params) (int32, bool) {
+	id, ok := restSwitchID(w, ps)
+	if ok && !MiGetCanWrite(id) {
+		writeRestError(w, http.StatusForbidden, "switch is read-only")
+		return 0, false
+	}
+	return id, ok
+}
+
+// restContext records switch changes made by the request as REST changes
+func restContext(r *http.Request) context.Context {
+	src := auditSourceFrom(r.Context())
+	src.Kind = sourceREST
+	return withAuditSource(r.Context(), src)
+}
+
+// restErrorStatus maps a failed switch command to a status code
+func restErrorStatus(err error) int {
+	if errors.Is(err, errShuttingDown) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway // the plug did not take the command
+}
+
+// decodeRestBody decodes a JSON body of at most maxRestBody bytes, rejecting
+// unknown fields. An empty body returns io.EOF.
+func decodeRestBody(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return err
+		}
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+func writeRestSwitch(w http.ResponseWriter, id int32) {
+	sw, ok := MiGetSwitch(id)
+	if !ok {
+		writeRestError(w, http.StatusNotFound, "no such switch")
+		return
+	}
+	writeJSON(w, http.StatusOK, sw)
+}
+
+func writeRestError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
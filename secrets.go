@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Tokens in settings.json may be stored encrypted as "enc:v1:<base64>",
+// where the payload is an AES-256-GCM nonce followed by the sealed token.
+// The key is 32 bytes, given hex or base64 encoded in MI_ALPACA_KEY or in
+// the file named by MI_ALPACA_KEY_FILE.
+const (
+	encryptedTokenPrefix = "enc:v1:"
+	keyEnv               = "MI_ALPACA_KEY"
+	keyFileEnv           = "MI_ALPACA_KEY_FILE"
+)
+
+var errNoTokenKey = fmt.Errorf("token is encrypted but neither %s nor %s is set", keyEnv, keyFileEnv)
+
+// deviceToken is a miIO device token. It never prints its value so a token
+// cannot end up in log output by accident.
+type deviceToken string
+
+func (t deviceToken) String() string {
+	if t == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+func (t deviceToken) GoString() string {
+	return t.String()
+}
+
+func (t deviceToken) encrypted() bool {
+	return strings.HasPrefix(string(t), encryptedTokenPrefix)
+}
+
+// plain returns the token in hex form, decrypting it when needed
+func (t deviceToken) plain() (deviceToken, error) {
+	if !t.encrypted() {
+		return t, nil
+	}
+	key, err := loadTokenKey()
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", errNoTokenKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(t), encryptedTokenPrefix))
+	if err != nil {
+		return "", errors.New("encrypted token is not valid base64")
+	}
+	gcm, err := newTokenCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted token is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("encrypted token cannot be decrypted with the configured key")
+	}
+	return deviceToken(plain), nil
+}
+
+// encrypt seals a plain token with key
+func (t deviceToken) encrypt(key []byte) (deviceToken, error) {
+	gcm, err := newTokenCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(t), nil)
+	return deviceToken(encryptedTokenPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// replaceTokens returns the settings document data with the token of device
+// i replaced by tokens[i]. Everything else is left as the operator wrote it.
+func replaceTokens(data []byte, tokens map[int]deviceToken) ([]byte, error) {
+	offsets, err := keyOffsets(data)
+	if err != nil {
+		return nil, err
+	}
+	type span struct {
+		start, end int
+		value      []byte
+	}
+	var spans []span
+	for i, t := range tokens {
+		field := fmt.Sprintf("devices[%d].token", i)
+		off, ok := offsets[field]
+		if !ok {
+			// encoding/json matches keys case-insensitively
+			for k, o := range offsets {
+				if strings.EqualFold(k, field) {
+					off, ok = o, true
+				}
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: not found", field)
+		}
+		start := int(off)
+		for start < len(data) && strings.IndexByte(" \t\r\n:", data[start]) >= 0 {
+			start++
+		}
+		dec := json.NewDecoder(bytes.NewReader(data[start:]))
+		var old string
+		if err := dec.Decode(&old); err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		value, err := json.Marshal(string(t))
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span{start, start + int(dec.InputOffset()), value})
+	}
+
+	// From the end, so earlier offsets stay valid
+	slices.SortFunc(spans, func(a, b span) int { return b.start - a.start })
+	out := slices.Clone(data)
+	for _, sp := range spans {
+		out = slices.Concat(out[:sp.start], sp.value, out[sp.end:])
+	}
+	return out, nil
+}
+
+func newTokenCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadTokenKey returns the configured token key, or nil when none is set
+func loadTokenKey() ([]byte, error) {
+	if v := os.Getenv(keyEnv); v != "" {
+		key, err := parseTokenKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyEnv, err)
+		}
+		return key, nil
+	}
+	if path := os.Getenv(keyFileEnv); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFileEnv, err)
+		}
+		key, err := parseTokenKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+func parseTokenKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("key must be 32 bytes, hex or base64 encoded")
+}
+
+// newTokenKey creates a random key and writes it hex encoded to path
+func newTokenKey(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
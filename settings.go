@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The operator edits settings.json and the server never writes it. Switch
+// values, names set through SetSwitchName and the connected flag live in
+// state.json, which belongs to the server.
+//
+// Loading rules at startup:
+//   - settings.json decides which devices exist and all of their configuration
+//   - state.json supplies connected and, matched by uniqueid, each device's
+//     value and Alpaca-assigned name; entries for unknown devices are dropped
+//   - without a state.json (first run after upgrading) the value and
+//     connected fields still present in an old settings.json are used
+const (
+	settingsFile = "settings.json"
+	stateFile    = "state.json"
+	stateBackups = 3 // rotated copies kept as state.json.bak.1 (newest) to .bak.3
+)
+
+// config is the operator configuration read from settings.json
+type config struct {
+	Devices []Device     `json:"devices"`
+	Poll    pollConfig   `json:"poll"`
+	Log     logConfig    `json:"log"`
+	MQTT    mqttConfig   `json:"mqtt"`
+	Auth    authConfig   `json:"auth"`
+	TLS     tlsConfig    `json:"tls"`
+	Access  accessConfig `json:"access"`
+	// Connected is only honoured for settings files written before state.json existed
+	Connected bool `json:"connected,omitempty"`
+}
+
+// pollConfig controls the background refresh of switch states
+type pollConfig struct {
+	Interval     *duration `json:"interval,omitempty"`     // time between polls, e.g. "30s"; "0s" disables polling
+	OfflineAfter int       `json:"offlineafter,omitempty"` // consecutive failed queries before a switch is marked offline
+	OfflineError bool      `json:"offlineerror,omitempty"` // fail reads of offline switches instead of returning the cached value
+}
+
+const (
+	defaultPollInterval = 30 * time.Second
+	defaultOfflineAfter = 3
+)
+
+// withDefaults fills in the settings left out of settings.json
+func (p pollConfig) withDefaults() pollConfig {
+	if p.Interval == nil {
+		d := duration(defaultPollInterval)
+		p.Interval = &d
+	}
+	if p.OfflineAfter == 0 {
+		p.OfflineAfter = defaultOfflineAfter
+	}
+	return p
+}
+
+// duration is a time.Duration written in JSON as a string such as "30s"
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// runtimeState is the volatile state the server persists in state.json
+type runtimeState struct {
+	Connected     bool                   `json:"connected"`
+	Devices       map[string]deviceState `json:"devices"`                 // keyed by uniqueid
+	AlpacaDevices map[string]string      `json:"alpacadevices,omitempty"` // UniqueID per Alpaca device, e.g. "Switch/1"
+	SwitchIDs     map[string]string      `json:"switchids,omitempty"`     // generated switch uniqueids, keyed by IP
+}
+
+// deviceState is the persisted state of a single switch
+type deviceState struct {
+	Value      int64  `json:"value"`
+	Customname string `json:"customname,omitempty"`
+}
+
+// saveMu serialises state writes so snapshots reach the disk in order
+var saveMu sync.Mutex
+
+// miSaveState writes the runtime state crash-safely, keeping the previous
+// versions as rotating backups
+func (s *sw) miSaveState() error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	sm.RLock()
+	st := runtimeState{
+		Connected:     s.Connected,
+		Devices:       make(map[string]deviceState, len(s.Devices)),
+		AlpacaDevices: s.alpacaIDs,
+		SwitchIDs:     s.switchIDs,
+	}
+	for _, d := range s.Devices {
+		st.Devices[d.Uniqueid] = deviceState{Value: d.Value, Customname: d.stateName}
+	}
+
+	data, err := json.MarshalIndent(&st, "", "    ")
+	sm.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := rotateBackups(stateFile, stateBackups); err != nil {
+		slog.Warn("Failed to rotate state backups", "error", err)
+	}
+	return writeFileAtomic(stateFile, data, 0600)
+}
+
+// miLoadSettings loads the configuration and merges the saved runtime state
+// into it following the loading rules above
+func (s *sw) miLoadSettings() error {
+	cfg, err := loadConfig(settingsFile)
+	if err != nil {
+		return err
+	}
+	if err := configureLogging(cfg.Log); err != nil {
+		return fmt.Errorf("log settings: %w", err)
+	}
+
+	var st runtimeState
+	haveState := true
+	if err := loadStateFile(&st); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Cannot load state, starting from the values in settings", "file", stateFile, "error", err)
+		}
+		haveState = false
+	}
+
+	// Alpaca ids first, so a legacy installation's first configured uniqueid
+	// is seen before generated ones are filled in
+	alpacaIDs, err := assignAlpacaIDs(st.AlpacaDevices, cfg.Devices)
+	if err != nil {
+		return err
+	}
+	switchIDs, err := resolveSwitchIDs(cfg.Devices, st.SwitchIDs)
+	if err != nil {
+		return err
+	}
+
+	connected := cfg.Connected
+	if haveState {
+		connected = st.Connected
+		for i := range cfg.Devices {
+			d := &cfg.Devices[i]
+			ds, ok := st.Devices[d.Uniqueid]
+			if !ok {
+				continue
+			}
+			d.Value = ds.Value
+			if ds.Customname != "" {
+				d.Customname = ds.Customname
+				d.stateName = ds.Customname
+			}
+		}
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+	s.Connected = connected
+	s.Devices = cfg.Devices
+	s.alpacaIDs = alpacaIDs
+	s.switchIDs = switchIDs
+	s.poll = cfg.Poll.withDefaults()
+	s.setMQTTConfig(cfg.MQTT)
+	s.auth = cfg.Auth
+	s.auth.warnLegacySecrets()
+	s.tls = cfg.TLS
+	s.access = cfg.Access.rules()
+	return nil
+}
+
+// loadStateFile loads state.json, falling back to the newest backup that can
+// still be parsed when the file is missing or damaged
+func loadStateFile(st *runtimeState) error {
+	removeStaleTempFiles(stateFile)
+
+	err := loadJSONFile(stateFile, st)
+	if err == nil {
+		return nil
+	}
+	for i := 1; i <= stateBackups; i++ {
+		backup := backupName(stateFile, i)
+		*st = runtimeState{}
+		if berr := loadJSONFile(backup, st); berr == nil {
+			slog.Warn("Using state backup", "backup", backup, "error", err)
+			return nil
+		}
+	}
+	return err
+}
+
+// loadJSONFile reads and decodes a JSON file
+// loadConfig reads and validates a settings file and decrypts its tokens
+// for use
+func loadConfig(path string) (*config, error) {
+	cfg, errs := validateConfigFile(path)
+	if errs != nil {
+		return nil, errs
+	}
+	for i := range cfg.Devices {
+		token, err := cfg.Devices[i].Token.plain()
+		if err != nil {
+			return nil, fmt.Errorf("devices[%d].token: %w", i, err)
+		}
+		cfg.Devices[i].Token = token
+	}
+	return cfg, nil
+}
+
+func loadJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// removeStaleTempFiles deletes temporary files left behind by a write that
+// was interrupted before its rename
+func removeStaleTempFiles(path string) {
+	matches, _ := filepath.Glob(path + "*.tmp*")
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.bak.%d", path, n)
+}
+
+// rotateBackups shifts path.bak.1..n-1 up by one and copies path to
+// path.bak.1. A file that no longer parses as JSON is not rotated so a
+// damaged write can never push the good copies out.
+func rotateBackups(path string, n int) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%s is damaged, not rotating it into the backups", path)
+	}
+
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(backupName(path, i), backupName(path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return writeFileAtomic(backupName(path, 1), data, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// flushes it to disk and renames it over path, so a crash leaves either the
+// old or the new contents but never a truncated file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once the rename has succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself. Directories cannot be synced on Windows,
+	// which is fine because NTFS journals the rename.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -33,7 +32,7 @@ func (srv *ApiServer) handleSwitchSetup(w http.ResponseWriter, r *http.Request,
 
 // handleMaxSwitch returns the number of switches (devices numbered from 0 to MaxSwitch - 1)
 func (srv *ApiServer) handleMaxSwitch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	resp := int32Response{Value: NumOnOffSwitch + NumVarSwitch}
+	resp := int32Response{Value: int32(MiGetMaxSwitch())}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -71,6 +70,11 @@ func (srv *ApiServer) handleGetSwitch(w http.ResponseWriter, r *http.Request, _
 		return
 	}
 
+	if err := MiCheckOnline(sn); err != nil {
+		srv.handleAlpacaError(w, r, errSwitchOfflineNumber, err.Error())
+		return
+	}
+
 	result, err := MiGetOnOff(sn)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
@@ -138,6 +142,11 @@ func (srv *ApiServer) handleGetSwitchValue(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if err := MiCheckOnline(sn); err != nil {
+		srv.handleAlpacaError(w, r, errSwitchOfflineNumber, err.Error())
+		return
+	}
+
 	resp := doubleResponse{Value: MiGetValue(sn)}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
@@ -185,7 +194,6 @@ func (srv *ApiServer) handleMaxSwitchValue(w http.ResponseWriter, r *http.Reques
 
 // handleSetSwitch sets the specified switch to the given state
 func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Print("Set Switch called")
 	sn, err := getIdFromRequest(r)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
@@ -196,7 +204,7 @@ func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _
 		return
 	}
 
-	log.Printf("Set Switch called for switch number %d", sn)
+	loggerFrom(r.Context()).Debug("Set switch called", "switch", sn)
 	sv, err := getSwitchStateFromRequest(r)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
@@ -207,7 +215,7 @@ func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _
 		return
 	}
 
-	err = MiSetOnOff(sn, sv)
+	err = MiSetOnOff(r.Context(), sn, sv)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
 		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
@@ -265,7 +273,6 @@ func (srv *ApiServer) handleSetSwitchName(w http.ResponseWriter, r *http.Request
 
 // handleSetSwitchValue sets the value of the specified switch
 func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Print("Set Switch value called")
 	sn, err := getIdFromRequest(r)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
@@ -276,7 +283,7 @@ func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	log.Printf("Set Switch value for switch number %d", sn)
+	loggerFrom(r.Context()).Debug("Set switch value called", "switch", sn)
 	sv, err := getValueFromRequest(r)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
@@ -288,7 +295,7 @@ func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Reques
 	}
 
 	newState := sv != 0
-	err = MiSetOnOff(sn, newState)
+	err = MiSetOnOff(r.Context(), sn, newState)
 	if err != nil {
 		resp := stringResponse{Value: err.Error()}
 		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
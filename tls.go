@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsConfig is the optional tls section of settings.json. The API is served
+// over plain HTTP unless a certificate is configured or selfsigned is set.
+type tlsConfig struct {
+	Cert       string `json:"cert,omitempty"`       // PEM certificate file, may hold the chain
+	Key        string `json:"key,omitempty"`        // PEM private key file
+	SelfSigned bool   `json:"selfsigned,omitempty"` // create a self-signed certificate in cert and key if they do not exist
+	// ClientCA is a PEM file of the CAs whose client certificates are
+	// accepted; see auth.certs for what they may do
+	ClientCA          string `json:"clientca,omitempty"`
+	RequireClientCert bool   `json:"requireclientcert,omitempty"` // refuse connections without a valid client certificate
+}
+
+const (
+	defaultTLSCert = "tls.crt"
+	defaultTLSKey  = "tls.key"
+
+	selfSignedValidity = 5 * 365 * 24 * time.Hour
+)
+
+// enabled reports whether the API is served over TLS
+func (c tlsConfig) enabled() bool {
+	return c.Cert != "" || c.SelfSigned
+}
+
+// withDefaults fills in the file names of a self-signed certificate
+func (c tlsConfig) withDefaults() tlsConfig {
+	if c.SelfSigned && c.Cert == "" && c.Key == "" {
+		c.Cert, c.Key = defaultTLSCert, defaultTLSKey
+	}
+	return c
+}
+
+func (s *sw) tlsConfig() tlsConfig {
+	sm.RLock()
+	defer sm.RUnlock()
+	return s.tls
+}
+
+// certReloader hands out the certificate and client CAs for each TLS
+// handshake, re-reading the files when they have changed, so renewed
+// certificates are picked up without a restart
+type certReloader struct {
+	c tlsConfig
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	files     []os.FileInfo // the files as they were when last loaded
+	checked   time.Time
+}
+
+// newCertReloader loads the configured certificate, creating a self-signed
+// one first when asked to
+func newCertReloader(c tlsConfig) (*certReloader, error) {
+	if c.SelfSigned {
+		if err := ensureSelfSigned(c.Cert, c.Key); err != nil {
+			return nil, fmt.Errorf("cannot create self-signed certificate: %w", err)
+		}
+	}
+	cr := &certReloader{c: c}
+	cr.files = cr.stat()
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	cr.checked = time.Now()
+	return cr, nil
+}
+
+// serverConfig returns the TLS settings for the API server
+func (cr *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: cr.configForClient,
+	}
+}
+
+func (cr *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.refresh()
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	c := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cr.cert},
+	}
+	if cr.clientCAs != nil {
+		c.ClientCAs = cr.clientCAs
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if cr.c.RequireClientCert {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return c, nil
+}
+
+// refresh reloads the files if they changed since the last look, which is
+// taken at most every reloadCheckInterval. A broken file keeps the
+// previous certificate in use.
+func (cr *certReloader) refresh() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) < reloadCheckInterval {
+		return
+	}
+	cr.checked = time.Now()
+
+	files := cr.stat()
+	changed := false
+	for i := range files {
+		if !sameFile(files[i], cr.files[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	cr.files = files
+	if err := cr.loadLocked(); err != nil {
+		slog.Warn("Cannot reload TLS certificate, keeping the current one", "error", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificate", "cert", cr.c.Cert, "expires", cr.cert.Leaf.NotAfter)
+}
+
+func (cr *certReloader) stat() []os.FileInfo {
+	paths := []string{cr.c.Cert, cr.c.Key}
+	if cr.c.ClientCA != "" {
+		paths = append(paths, cr.c.ClientCA)
+	}
+	files := make([]os.FileInfo, len(paths))
+	for i, p := range paths {
+		files[i], _ = os.Stat(p)
+	}
+	return files
+}
+
+func (cr *certReloader) load() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.loadLocked()
+}
+
+func (cr *certReloader) loadLocked() error {
+	cert, err := tls.LoadX509KeyPair(cr.c.Cert, cr.c.Key)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	var pool *x509.CertPool
+	if cr.c.ClientCA != "" {
+		if pool, err = loadCertPool(cr.c.ClientCA); err != nil {
+			return err
+		}
+	}
+	cr.cert, cr.clientCAs = &cert, pool
+	return nil
+}
+
+// loadCertPool reads a PEM file of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// ensureSelfSigned writes a new self-signed certificate and key unless
+// both files already exist
+func ensureSelfSigned(certFile, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if certErr == nil || keyErr == nil {
+		return fmt.Errorf("only one of %s and %s exists", certFile, keyFile)
+	}
+	if !errors.Is(certErr, os.ErrNotExist) {
+		return certErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mi_alpaca", Organization: []string{"Mi Alpaca"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  localIPs(),
+	}
+	if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := writeFileAtomic(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	fp := sha256.Sum256(der)
+	slog.Info("Created self-signed TLS certificate", "cert", certFile, "key", keyFile, "sha256", hex.EncodeToString(fp[:]))
+	return nil
+}
+
+// localIPs returns the addresses of this host, for the certificate to be
+// valid however the server is reached
+func localIPs() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips
+}
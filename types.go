@@ -1,5 +1,14 @@
 package main
 
+// ASCOM Alpaca error numbers
+const (
+	errInvalidValue         = 0x401
+	errActionNotImplemented = 0x40C
+	errDriverBase           = 0x500 // first number reserved for driver specific errors
+	errSwitchOfflineNumber  = errDriverBase + 1
+	errRateLimitedNumber    = errDriverBase + 2
+)
+
 // alpacaResponse contains the common ASCOM Alpaca response fields
 type alpacaResponse struct {
 	ClientTransactionID uint32 `json:"ClientTransactionID"`
@@ -76,3 +85,27 @@ type ServerDescription struct {
 	ManufacturerVersion string `json:"ManufacturerVersion"`
 	Location            string `json:"Location"`
 }
+
+// auditResponse returns entries of the audit log
+type auditResponse struct {
+	Value []auditEntry `json:"Value"`
+	alpacaResponse
+}
+
+// deviceHealthResponse returns the health of every switch
+type deviceHealthResponse struct {
+	Value []DeviceHealth `json:"Value"`
+	alpacaResponse
+}
+
+// DeviceHealth describes how a switch has been answering
+type DeviceHealth struct {
+	Id                  int32   `json:"Id"`
+	Name                string  `json:"Name"`
+	Online              bool    `json:"Online"`
+	LastSeen            string  `json:"LastSeen,omitempty"` // RFC 3339, UTC
+	LastError           string  `json:"LastError,omitempty"`
+	LastErrorTime       string  `json:"LastErrorTime,omitempty"`
+	ConsecutiveFailures int     `json:"ConsecutiveFailures"`
+	RoundTripMs         float64 `json:"RoundTripMs"` // last successful exchange
+}
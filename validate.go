@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configError is a single problem found in a configuration file
+type configError struct {
+	File  string
+	Line  int    // 0 when the problem has no position, e.g. an unreadable file
+	Col   int    // byte column in Line, from 1
+	Field string // JSON path such as devices[2].token
+	Msg   string
+}
+
+func (e configError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+		if e.Col > 0 {
+			fmt.Fprintf(&b, ":%d", e.Col)
+		}
+	}
+	if e.Field != "" {
+		b.WriteString(": " + e.Field)
+	}
+	b.WriteString(": " + e.Msg)
+	return b.String()
+}
+
+// configErrors lists every problem found in a configuration file
+type configErrors []configError
+
+func (errs configErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateConfigFile parses and checks a settings file. It returns the
+// decoded configuration only when no problems were found.
+func validateConfigFile(path string) (*config, configErrors) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, configErrors{{File: path, Msg: err.Error()}}
+	}
+
+	w := &jsonWalker{
+		dec:     json.NewDecoder(bytes.NewReader(data)),
+		data:    data,
+		file:    path,
+		offsets: make(map[string]int64),
+	}
+	if err := w.value("", reflect.TypeOf(config{})); err != nil {
+		return nil, configErrors{w.syntaxError(err)}
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			line, col := position(data, tokenStart(data, te.Offset))
+			return nil, append(w.errs, configError{
+				File:  path,
+				Line:  line,
+				Col:   col,
+				Field: typeErrorPath(te.Field),
+				Msg:   fmt.Sprintf("expected %s, got %s", te.Type, te.Value),
+			})
+		}
+		return nil, append(w.errs, configError{File: path, Msg: err.Error()})
+	}
+
+	w.checkDevices(cfg.Devices)
+	w.checkPoll(cfg.Poll)
+	w.checkLog(cfg.Log)
+	w.checkMQTT(cfg.MQTT)
+	w.checkAuth(cfg.Auth, len(cfg.Devices))
+	w.checkTLS(cfg.TLS)
+	w.checkAccess(cfg.Access)
+	if len(cfg.Auth.Certs) > 0 && cfg.TLS.ClientCA == "" {
+		w.fail("auth.certs", "needs tls.clientca")
+	}
+	if len(w.errs) > 0 {
+		return nil, w.errs
+	}
+	return &cfg, nil
+}
+
+// checkDevices applies the semantic rules to the device list. Encrypted
+// tokens are checked in their decrypted form.
+func (w *jsonWalker) checkDevices(devices []Device) {
+	if len(devices) == 0 {
+		w.fail("devices", "no devices configured")
+		return
+	}
+
+	seen := make(map[string]int)
+	for i, d := range devices {
+		p := fmt.Sprintf("devices[%d]", i)
+
+		token, err := d.Token.plain()
+		switch {
+		case err != nil:
+			w.fail(p+".token", err.Error())
+		case len(token) != 32:
+			w.fail(p+".token", fmt.Sprintf("must be 32 hex characters, has %d", len(token)))
+		default:
+			if _, err := hex.DecodeString(string(token)); err != nil {
+				w.fail(p+".token", "must contain only hex characters 0-9 and a-f")
+			}
+		}
+
+		if d.IP == "" {
+			w.fail(p+".ip", "missing")
+		} else if net.ParseIP(d.IP) == nil {
+			w.fail(p+".ip", fmt.Sprintf("%q is not an IP address", d.IP))
+		}
+
+		// A missing uniqueid is generated at startup, see resolveSwitchIDs
+		if d.Uniqueid != "" {
+			if first, dup := seen[strings.ToLower(d.Uniqueid)]; dup {
+				w.fail(p+".uniqueid", fmt.Sprintf("duplicates devices[%d].uniqueid", first))
+			} else {
+				seen[strings.ToLower(d.Uniqueid)] = i
+			}
+		}
+
+		if d.Id != uint32(i) {
+			w.fail(p+".id", fmt.Sprintf("is %d, expected %d (ids count from 0 in file order)", d.Id, i))
+		}
+		if d.Number != d.Id+1 {
+			w.fail(p+".number", fmt.Sprintf("is %d, expected id+1 = %d", d.Number, d.Id+1))
+		}
+
+		if d.Min >= d.Max {
+			w.fail(p+".min", fmt.Sprintf("min (%d) must be less than max (%d)", d.Min, d.Max))
+		}
+		if d.Step <= 0 {
+			w.fail(p+".step", fmt.Sprintf("must be greater than 0, is %d", d.Step))
+		}
+	}
+}
+
+// checkPoll checks the background polling settings
+func (w *jsonWalker) checkPoll(p pollConfig) {
+	if p.Interval != nil && *p.Interval != 0 && time.Duration(*p.Interval) < time.Second {
+		w.fail("poll.interval", fmt.Sprintf("must be at least 1s or 0s to disable polling, is %s", time.Duration(*p.Interval)))
+	}
+	if p.OfflineAfter < 0 {
+		w.fail("poll.offlineafter", "must not be negative")
+	}
+}
+
+// checkLog checks the log level and format
+func (w *jsonWalker) checkLog(l logConfig) {
+	if _, err := parseLogLevel(l.Level); err != nil {
+		w.fail("log.level", "must be debug, info, warn or error")
+	}
+	if f := strings.ToLower(l.Format); f != "" && f != "text" && f != "json" {
+		w.fail("log.format", "must be text or json")
+	}
+}
+
+// checkMQTT checks the broker address and topics of the MQTT bridge
+func (w *jsonWalker) checkMQTT(c mqttConfig) {
+	if c.Broker == "" {
+		return
+	}
+	if _, _, err := parseBrokerURL(c.Broker); err != nil {
+		w.fail("mqtt.broker", err.Error())
+	}
+	if c.Password != "" && c.Username == "" {
+		w.fail("mqtt.password", "needs a username")
+	}
+	topics := []struct{ field, topic string }{
+		{"mqtt.topic", c.Topic},
+		{"mqtt.discoveryprefix", c.DiscoveryPrefix},
+	}
+	for _, t := range topics {
+		if strings.ContainsAny(t.topic, "+#") || strings.HasPrefix(t.topic, "/") || strings.HasSuffix(t.topic, "/") {
+			w.fail(t.field, "must not contain + or # or start or end with /")
+		}
+	}
+}
+
+// checkAuth checks the users and tokens allowed to use the API
+func (w *jsonWalker) checkAuth(c authConfig, devices int) {
+	if c.AnonymousAlpaca != "" && !validRole(c.AnonymousAlpaca) {
+		w.fail("auth.anonymousalpaca", "must be readonly or operator, or empty to require credentials")
+	}
+	if c.AnonymousAlpaca != "" && !c.enabled() {
+		w.fail("auth.anonymousalpaca", "has no effect without users or tokens")
+	}
+
+	names := make(map[string]string)
+	check := func(p, name, secret, secretField, role string, switches []int32) {
+		if name == "" {
+			w.fail(p+".name", "missing")
+		} else if first, dup := names[name]; dup {
+			w.fail(p+".name", fmt.Sprintf("duplicates %s.name", first))
+		} else {
+			names[name] = p
+		}
+		// Client certificates have no secret, the TLS handshake checks them
+		if secretField != "" {
+			if secret == "" {
+				w.fail(p+"."+secretField, "missing")
+			} else if _, _, err := parseHashedSecret(secret); err != nil {
+				w.fail(p+"."+secretField, err.Error())
+			}
+		}
+		if !validRole(role) {
+			w.fail(p+".role", "must be readonly or operator")
+		}
+		for j, id := range switches {
+			if id < 0 || int(id) >= devices {
+				w.fail(fmt.Sprintf("%s.switches[%d]", p, j), fmt.Sprintf("no switch with id %d", id))
+			}
+		}
+	}
+	for i, u := range c.Users {
+		check(fmt.Sprintf("auth.users[%d]", i), u.Name, u.Password, "password", u.Role, u.Switches)
+	}
+	for i, t := range c.Tokens {
+		check(fmt.Sprintf("auth.tokens[%d]", i), t.Name, t.Token, "token", t.Role, t.Switches)
+	}
+	for i, cc := range c.Certs {
+		check(fmt.Sprintf("auth.certs[%d]", i), cc.Name, "", "", cc.Role, cc.Switches)
+	}
+}
+
+// checkTLS checks that the certificate, key and client CAs can be loaded
+func (w *jsonWalker) checkTLS(c tlsConfig) {
+	c = c.withDefaults()
+	if (c.Cert == "") != (c.Key == "") {
+		w.fail("tls", "cert and key must be set together")
+		return
+	}
+	if c.Cert != "" {
+		_, certErr := os.Stat(c.Cert)
+		_, keyErr := os.Stat(c.Key)
+		// A self-signed certificate is created when neither file exists yet
+		if !c.SelfSigned || certErr == nil || keyErr == nil {
+			if _, err := tls.LoadX509KeyPair(c.Cert, c.Key); err != nil {
+				w.fail("tls.cert", err.Error())
+			}
+		}
+	}
+	if c.ClientCA != "" {
+		if !c.enabled() {
+			w.fail("tls.clientca", "needs cert and key or selfsigned")
+		}
+		if _, err := loadCertPool(c.ClientCA); err != nil {
+			w.fail("tls.clientca", err.Error())
+		}
+	}
+	if c.RequireClientCert && c.ClientCA == "" {
+		w.fail("tls.requireclientcert", "needs clientca")
+	}
+}
+
+// checkAccess checks the allowlists and rate limits
+func (w *jsonWalker) checkAccess(c accessConfig) {
+	lists := []struct {
+		field   string
+		entries []string
+	}{
+		{"access.api", c.API},
+		{"access.discovery", c.Discovery},
+	}
+	for _, l := range lists {
+		for i, e := range l.entries {
+			if _, err := parseAllowEntry(e); err != nil {
+				w.fail(fmt.Sprintf("%s[%d]", l.field, i), fmt.Sprintf("%q is not an address or CIDR", e))
+			}
+		}
+	}
+	if c.SetRate < 0 {
+		w.fail("access.setrate", "must not be negative")
+	}
+	if c.SetBurst < 0 {
+		w.fail("access.setburst", "must not be negative")
+	}
+}
+
+// keyOffsets returns the offset just past every key of a settings document,
+// by JSON path as in configError.Field
+func keyOffsets(data []byte) (map[string]int64, error) {
+	w := &jsonWalker{
+		dec:     json.NewDecoder(bytes.NewReader(data)),
+		data:    data,
+		offsets: make(map[string]int64),
+	}
+	if err := w.value("", reflect.TypeOf(config{})); err != nil {
+		return nil, err
+	}
+	return w.offsets, nil
+}
+
+// jsonWalker streams through a JSON document, recording where every field
+// starts and reporting keys that the target type does not know about
+type jsonWalker struct {
+	dec     *json.Decoder
+	data    []byte
+	file    string
+	offsets map[string]int64
+	errs    configErrors
+}
+
+// fail records a problem at the line of the given field, or of the closest
+// parent that appears in the file
+func (w *jsonWalker) fail(field, msg string) {
+	line, col := 0, 0
+	for p := field; p != ""; p = parentPath(p) {
+		if off, ok := w.offsets[p]; ok {
+			line, col = position(w.data, tokenStart(w.data, off))
+			break
+		}
+	}
+	w.errs = append(w.errs, configError{File: w.file, Line: line, Col: col, Field: field, Msg: msg})
+}
+
+func (w *jsonWalker) syntaxError(err error) configError {
+	// The decoder used for walking stops at the token before the fault;
+	// a plain Unmarshal reports the exact offset
+	var v interface{}
+	if uerr := json.Unmarshal(w.data, &v); uerr != nil {
+		err = uerr
+	}
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		// Offset counts the offending byte
+		line, col := position(w.data, int(se.Offset)-1)
+		return configError{File: w.file, Line: line, Col: col, Msg: "invalid JSON: " + se.Error()}
+	}
+	return configError{File: w.file, Msg: "invalid JSON: " + err.Error()}
+}
+
+// value consumes one JSON value at path. t is the Go type it decodes into,
+// or nil when unknown.
+func (w *jsonWalker) value(path string, t reflect.Type) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, ok := w.offsets[path]; !ok {
+		w.offsets[path] = w.dec.InputOffset()
+	}
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	switch delim {
+	case '{':
+		fields := jsonFields(t)
+		for w.dec.More() {
+			ktok, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key := ktok.(string)
+			kpath := joinPath(path, key)
+			w.offsets[kpath] = w.dec.InputOffset()
+
+			var ft reflect.Type
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Struct:
+					var known bool
+					if ft, known = fields[strings.ToLower(key)]; !known {
+						w.fail(kpath, "unknown field")
+					}
+				case reflect.Map:
+					ft = t.Elem()
+				}
+			}
+			if err := w.value(kpath, ft); err != nil {
+				return err
+			}
+		}
+	case '[':
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		for i := 0; w.dec.More(); i++ {
+			if err := w.value(fmt.Sprintf("%s[%d]", path, i), et); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = w.dec.Token() // closing delimiter
+	return err
+}
+
+// jsonFields maps the lower-cased JSON names of a struct's exported fields to
+// their types, matching encoding/json's case-insensitive decoding
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+// typeErrorPath turns encoding/json's devices.0.ip into devices[0].ip
+func typeErrorPath(field string) string {
+	parts := strings.Split(field, ".")
+	var b strings.Builder
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// parentPath strips the last element from a path such as devices[2].token
+func parentPath(p string) string {
+	if i := strings.LastIndexAny(p, ".["); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// position returns the line and column, both from 1, of the byte at index i
+func position(data []byte, i int) (int, int) {
+	i = max(0, min(i, len(data)))
+	line := 1 + bytes.Count(data[:i], []byte("\n"))
+	return line, i - bytes.LastIndexByte(data[:i], '\n')
+}
+
+// tokenStart returns where the JSON token that ends at end starts: the
+// opening quote of a key or string, or the first byte of anything else
+func tokenStart(data []byte, end int64) int {
+	i := int(min(end, int64(len(data)))) - 1
+	if i < 0 {
+		return 0
+	}
+	if data[i] == '"' {
+		for j := i - 1; j >= 0; j-- {
+			if data[j] == '"' && !escaped(data, j) {
+				return j
+			}
+		}
+		return i
+	}
+	for i > 0 && strings.IndexByte(" \t\r\n,:[{", data[i-1]) < 0 {
+		i--
+	}
+	return i
+}
+
+// escaped reports whether the byte at i follows an odd number of backslashes
+func escaped(data []byte, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && data[j] == '\\'; j-- {
+		n++
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// validSettings is a settings file with one switch, laid out so the tests
+// can name lines and columns
+const validSettings = `{
+  "devices": [
+    {
+      "ip": "127.0.0.2",
+      "token": "3ab8e0b83a1a31a7a548aa5d8a7c7fa1",
+      "name": "Switch 1", "devicetype": "Switch",
+      "number": 1, "id": 0, "min": 0, "max": 1, "step": 1, "canwrite": true
+    }
+  ]
+}
+`
+
+func TestValidateConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string // replaced in validSettings by new
+		new  string
+		doc  string // used instead of validSettings when set
+		want []configError
+	}{
+		{name: "valid"},
+		{
+			name: "short token",
+			old:  "3ab8e0b83a1a31a7a548aa5d8a7c7fa1",
+			new:  "3ab8e0b83a1a31a7a548aa5d8a7c7f",
+			want: []configError{{Line: 5, Col: 7, Field: "devices[0].token", Msg: "must be 32 hex characters, has 30"}},
+		},
+		{
+			name: "token not hex",
+			old:  "3ab8e0b83a1a31a7a548aa5d8a7c7fa1",
+			new:  "3ab8e0b83a1a31a7a548aa5d8a7c7fxy",
+			want: []configError{{Line: 5, Col: 7, Field: "devices[0].token", Msg: "must contain only hex characters 0-9 and a-f"}},
+		},
+		{
+			name: "bad IP address",
+			old:  "127.0.0.2",
+			new:  "300.1.1.1",
+			want: []configError{{Line: 4, Col: 7, Field: "devices[0].ip", Msg: `"300.1.1.1" is not an IP address`}},
+		},
+		{
+			name: "min not below max",
+			old:  `"max": 1`,
+			new:  `"max": 0`,
+			want: []configError{{Line: 7, Col: 29, Field: "devices[0].min", Msg: "min (0) must be less than max (0)"}},
+		},
+		{
+			name: "unknown field",
+			old:  `"canwrite": true`,
+			new:  "\"canwrite\": true,\n      \"colour\": \"red\"",
+			want: []configError{{Line: 8, Col: 7, Field: "devices[0].colour", Msg: "unknown field"}},
+		},
+		{
+			name: "unknown field with an escaped quote",
+			old:  `"canwrite": true`,
+			new:  "\"canwrite\": true,\n      \"a\\\"b\": 1",
+			want: []configError{{Line: 8, Col: 7, Field: `devices[0].a"b`, Msg: "unknown field"}},
+		},
+		{
+			name: "wrong type",
+			old:  `"number": 1`,
+			new:  `"number": "1"`,
+			want: []configError{{Line: 7, Col: 17, Field: "devices[0].number", Msg: "expected uint32, got string"}},
+		},
+		{
+			name: "syntax error",
+			old:  `"127.0.0.2",`,
+			new:  `"127.0.0.2",,`,
+			want: []configError{{Line: 4, Col: 25, Msg: "invalid JSON: invalid character ',' looking for beginning of object key string"}},
+		},
+		{
+			name: "error on the parent",
+			doc:  "{\n  \"devices\": []\n}\n",
+			want: []configError{{Line: 2, Col: 3, Field: "devices", Msg: "no devices configured"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := tt.doc
+			if doc == "" {
+				doc = strings.Replace(validSettings, tt.old, tt.new, 1)
+			}
+			path := filepath.Join(t.TempDir(), "settings.json")
+			if err := os.WriteFile(path, []byte(doc), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.want {
+				tt.want[i].File = path
+			}
+
+			_, errs := validateConfigFile(path)
+			if !slices.Equal(errs, configErrors(tt.want)) {
+				t.Errorf("got  %v\nwant %v", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigErrorString(t *testing.T) {
+	tests := []struct {
+		err  configError
+		want string
+	}{
+		{configError{File: "settings.json", Line: 5, Col: 7, Field: "devices[0].token", Msg: "missing"}, "settings.json:5:7: devices[0].token: missing"},
+		{configError{File: "settings.json", Line: 5, Msg: "bad"}, "settings.json:5: bad"},
+		{configError{File: "settings.json", Msg: "no such file"}, "settings.json: no such file"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
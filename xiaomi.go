@@ -1,46 +1,64 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 )
 
-// miOnOff turns the specified Xiaomi Mi Smart Plug on or off
-// Device numbers start at 1. powerOn is true to turn on, false to turn off.
-func miOnOff(deviceNum int32, powerOn bool) error {
-	devices := MiGetDevices()
-
-	deviceNum = deviceNum + 1
+// Errors reported by the miIO protocol layer, see miioErrorType
+var (
+	errChecksum    = errors.New("response checksum mismatch")
+	errDecrypt     = errors.New("cannot decrypt response")
+	errBadResponse = errors.New("invalid response")
+)
 
-	if deviceNum < 1 || deviceNum > int32(len(devices)) {
-		return fmt.Errorf("device number must be between 1 and %d", len(devices))
+// miioErrorType classifies a device error for the metrics
+func miioErrorType(err error) string {
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, errChecksum):
+		return "checksum"
+	case errors.Is(err, errDecrypt):
+		return "decrypt"
+	case errors.Is(err, errBadResponse):
+		return "response"
+	default:
+		return "network"
 	}
+}
 
-	device := devices[deviceNum-1]
-	token, err := hex.DecodeString(device.Token)
+// miOnOff turns the specified Xiaomi Mi Smart Plug on or off
+// powerOn is true to turn on, false to turn off. It reports whether the plug
+// acknowledged the command. The caller must hold the plug, see acquirePlug.
+func miOnOff(device Device, powerOn bool) (bool, error) {
+	token, err := hex.DecodeString(string(device.Token))
 	if err != nil {
-		return fmt.Errorf("error decoding token: %v", err)
+		return false, fmt.Errorf("error decoding token: %v", err)
 	}
 
 	// Discover the device
 	deviceID, stamp, err := discoverDevice(device.IP)
 	if err != nil {
-		return fmt.Errorf("discovery error: %v", err)
+		return false, fmt.Errorf("discovery error: %w", err)
 	}
 
 	// Set power state
-	err = setPower(device.IP, token, deviceID, stamp, powerOn)
+	confirmed, err := setPower(device.IP, token, deviceID, stamp, powerOn)
 	if err != nil {
-		return fmt.Errorf("failed to set power: %v", err)
+		return false, fmt.Errorf("failed to set power: %w", err)
 	}
 
-	return nil
+	return confirmed, nil
 }
 
 // discoverDevice sends a hello packet to the Xiaomi device and retrieves device ID and timestamp
@@ -77,11 +95,12 @@ func discoverDevice(ipAddress string) ([]byte, []byte, error) {
 		return buffer[8:12], buffer[12:16], nil
 	}
 
-	return nil, nil, fmt.Errorf("invalid response")
+	return nil, nil, errBadResponse
 }
 
-// setPower sends a power command to the Xiaomi device
-func setPower(ipAddress string, token []byte, deviceID []byte, stamp []byte, powerOn bool) error {
+// setPower sends a power command to the Xiaomi device and reports whether
+// the device acknowledged it
+func setPower(ipAddress string, token []byte, deviceID []byte, stamp []byte, powerOn bool) (bool, error) {
 	state := "off"
 	if powerOn {
 		state = "on"
@@ -95,33 +114,52 @@ func setPower(ipAddress string, token []byte, deviceID []byte, stamp []byte, pow
 
 	jsonData, err := json.Marshal(command)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	encrypted, err := encryptPayload(jsonData, token)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	packet := buildPacket(token, deviceID, stamp, encrypted)
 
 	conn, err := net.DialTimeout("udp", fmt.Sprintf("%s:54321", ipAddress), 5*time.Second)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer conn.Close()
 
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	_, err = conn.Write(packet)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// Try to read response (may timeout, which is OK)
+	// Try to read response (may timeout, which is OK but unconfirmed)
 	buffer := make([]byte, 1024)
-	_, _ = conn.Read(buffer)
+	n, err := conn.Read(buffer)
+	if err != nil || n < 32 || !verifyChecksum(buffer[:n], token) {
+		return false, nil
+	}
+	decrypted, err := decryptPayload(buffer[32:n], token)
+	if err != nil {
+		return false, nil
+	}
 
-	return nil
+	var response struct {
+		Result []string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(decrypted, &response) != nil {
+		return false, nil
+	}
+	if response.Error != nil {
+		return false, fmt.Errorf("%w: device refused: %s", errBadResponse, response.Error.Message)
+	}
+	return len(response.Result) > 0 && response.Result[0] == "ok", nil
 }
 
 // buildPacket constructs a Xiaomi protocol packet with encryption and checksum
@@ -220,18 +258,9 @@ func decryptPayload(encryptedData []byte, token []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// miQueryPower queries the actual power state from the Xiaomi device
-func miQueryPower(deviceNum int32) (bool, error) {
-	devices := MiGetDevices()
-
-	deviceNum = deviceNum + 1
-
-	if deviceNum < 1 || deviceNum > int32(len(devices)) {
-		return false, fmt.Errorf("device number must be between 1 and %d", len(devices))
-	}
-
-	device := devices[deviceNum-1]
-	token, err := hex.DecodeString(device.Token)
+// queryPower queries the actual power state of the given device
+func queryPower(device Device) (bool, error) {
+	token, err := hex.DecodeString(string(device.Token))
 	if err != nil {
 		return false, fmt.Errorf("error decoding token: %v", err)
 	}
@@ -239,7 +268,7 @@ func miQueryPower(deviceNum int32) (bool, error) {
 	// Discover the device
 	deviceID, stamp, err := discoverDevice(device.IP)
 	if err != nil {
-		return false, fmt.Errorf("discovery error: %v", err)
+		return false, fmt.Errorf("discovery error: %w", err)
 	}
 
 	// Query power state
@@ -277,18 +306,23 @@ func miQueryPower(deviceNum int32) (bool, error) {
 	buffer := make([]byte, 1024)
 	n, err := conn.Read(buffer)
 	if err != nil {
-		return false, fmt.Errorf("failed to read response: %v", err)
+		return false, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	if n < 32 {
-		return false, fmt.Errorf("response too short")
+		return false, fmt.Errorf("%w: response too short", errBadResponse)
 	}
 
-	// Decrypt the response payload
+	// Check the response really comes from a device holding our token
 	encryptedResponse := buffer[32:n]
+	if !verifyChecksum(buffer[:n], token) {
+		return false, errChecksum
+	}
+
+	// Decrypt the response payload
 	decrypted, err := decryptPayload(encryptedResponse, token)
 	if err != nil {
-		return false, fmt.Errorf("failed to decrypt response: %v", err)
+		return false, fmt.Errorf("%w: %v", errDecrypt, err)
 	}
 
 	// Parse JSON response
@@ -297,12 +331,23 @@ func miQueryPower(deviceNum int32) (bool, error) {
 	}
 	err = json.Unmarshal(decrypted, &response)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse response: %v", err)
+		// Decrypted fine, so the token is right; the plug sent something odd
+		return false, fmt.Errorf("%w: %v", errBadResponse, err)
 	}
 
 	if len(response.Result) > 0 {
 		return response.Result[0] == "on", nil
 	}
 
-	return false, fmt.Errorf("no power state in response")
+	return false, fmt.Errorf("%w: no power state in response", errBadResponse)
+}
+
+// verifyChecksum checks the MD5 checksum of a received packet, computed like
+// in buildPacket over the header, the token and the encrypted data
+func verifyChecksum(packet, token []byte) bool {
+	sum := md5.New()
+	sum.Write(packet[0:16])
+	sum.Write(token)
+	sum.Write(packet[32:])
+	return bytes.Equal(sum.Sum(nil), packet[16:32])
 }